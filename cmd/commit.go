@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	Commit = cobra.Command{
+		Use:   "commit PATH",
+		Short: "write ramdisk changes into the original data and keep the ramdisk",
+		Long: `
+write ramdisk changes into the original data and keep the ramdisk
+
+All changes stored in the ramdisk are merged into the original data,
+just like with the merge command. The ramdisk is then reset to a clean
+state on top of the updated original data and stays mounted.
+
+The changed files are copied while the ramdisk is still mounted,
+the overlay is remounted only for a short while afterwards.
+All inodes are invalidated by the remount, make sure all files
+and directories in the target location are closed.
+
+If a snapshot is applied, its contents are merged as well,
+and the ramdisk is reset to snapshot ID 0.
+
+Should the commit fail or get interrupted, it can be finished
+with --resume, or reverted with --abort.
+
+Conflicts with changes made in the source directory of a --target
+ramdisk are resolved with --strategy, see the merge command.
+--checksum leaves out files that have been copied up into the ramdisk
+without any changes.
+`,
+		Example: `
+# Periodically checkpoint build artefacts in /foo/bar to disk
+eph commit /foo/bar
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkPathArg(args); err != nil {
+				return err
+			}
+
+			if commitResume && commitAbort {
+				return errors.New("--resume and --abort are mutually exclusive")
+			}
+
+			// Committing mounts the overlay back with layer paths derived from p.
+			// mountinfo lists them as given, eph list and eph fsck look for
+			// absolute ones.
+			p := absPath(stripTrailingSlash(args[0]))
+
+			var err error
+			switch {
+			case commitResume:
+				err = eph.ResumeMerge(p)
+			case commitAbort:
+				err = eph.AbortMerge(p)
+			default:
+				err = eph.Commit(p, eph.MergeOptions{NoBackup: commitNoBackup, Strategy: commitStrategy, Checksum: commitChecksum})
+			}
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	commitResume   bool
+	commitAbort    bool
+	commitNoBackup bool
+	commitStrategy string
+	commitChecksum bool
+)
+
+func init() {
+	Commit.PersistentFlags().BoolVar(&commitResume, "resume", false, "resume an interrupted commit")
+	Commit.PersistentFlags().BoolVar(&commitAbort, "abort", false, "abort an interrupted commit and restore the original data")
+	Commit.PersistentFlags().BoolVar(&commitNoBackup, "no-backup", false, "don't back up the original data overwritten by the commit")
+	Commit.PersistentFlags().BoolVar(&commitChecksum, "checksum", false, "compare contents of files and leave out the unchanged ones")
+	Commit.PersistentFlags().StringVar(&commitStrategy, "strategy", eph.StrategyFail, "resolve conflicts with changes in the source directory of a --target ramdisk: ours, theirs or fail")
+}
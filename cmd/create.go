@@ -71,7 +71,7 @@ eph create -o /bar
 			}
 
 			// Note: absPath() is needed for --target, so that the symlink to source is in absolute path
-			if err := eph.Create(absPath(p), createTarget, createQuota); err != nil {
+			if err := eph.Create(absPath(p), createTarget, createQuota, createHashManifest); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 
 				if !createOverlay {
@@ -81,6 +81,15 @@ eph create -o /bar
 				os.Exit(1)
 			}
 
+			if createTarget != "" {
+				p = createTarget
+			}
+
+			if err := eph.PrintRamdiskInfo(absPath(stripTrailingSlash(p))); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
 			return nil
 		},
 	}
@@ -88,10 +97,13 @@ eph create -o /bar
 	createQuota   string
 	createOverlay bool
 	createTarget  string
+
+	createHashManifest bool
 )
 
 func init() {
 	Create.PersistentFlags().StringVarP(&createQuota, "quota", "q", "100M", "ramdisk capacity quota; accepts K,M,G units")
 	Create.PersistentFlags().BoolVarP(&createOverlay, "overlay", "o", false, "overlay over an existing directory")
 	Create.PersistentFlags().StringVarP(&createTarget, "target", "t", "", "mount overlay target at specified location instead of the path supplied to the create command. The directory in create path is left unmodified.")
+	Create.PersistentFlags().BoolVar(&createHashManifest, "hash-manifest", false, "with --target, record hashes of all files in the source directory to detect conflicting changes more precisely")
 }
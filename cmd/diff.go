@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	Diff = cobra.Command{
+		Use:   "diff PATH [SUBPATH...]",
+		Short: "display differences in contents of changed files",
+		Long: `
+display differences in contents of changed files
+
+Changed files are compared against their original versions and the differences
+are printed in the unified diff format. Binary files, files larger than 4 MiB
+and files with too many changes scattered across them to be diffed quickly
+are only reported as differing. Changes of permissions, ownership or extended
+attributes are not shown, see the status command for those.
+
+Only changes under the listed paths, relative to PATH, are shown.
+`,
+		Example: `
+# Review the changes in src/ before merging /foo/bar
+eph diff /foo/bar src | less
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("missing path")
+			}
+
+			if args[0] == layout.BaseOverride {
+				return errors.New("eph root collision")
+			}
+
+			if err := eph.PrintDiff(stripTrailingSlash(args[0]), args[1:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+)
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	Du = cobra.Command{
+		Use:   "du PATH [-d N]",
+		Short: "display disk usage of the ramdisk",
+		Long: `
+display disk usage of the ramdisk
+
+Shows how much of the ramdisk's space is taken by each directory in the
+upper layer of the overlay, i.e. by the changes made to it, up to --depth
+levels deep. The COPY-UPS column is the part of it taken by copies of files
+that already exist in the original data or in the applied snapshot, e.g.
+files that have been modified or only had their permissions changed.
+The space taken by the snapshot images and the usage of the whole
+ramdisk out of its quota follow.
+`,
+		Example: `
+# Find out what fills up /foo/bar, two levels deep
+eph du /foo/bar --depth 2
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkPathArg(args); err != nil {
+				return err
+			}
+
+			if err := eph.PrintDiskUsage(stripTrailingSlash(args[0]), duDepth); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	duDepth int
+)
+
+func init() {
+	Du.PersistentFlags().IntVarP(&duDepth, "depth", "d", 1, "show directories at most N levels deep; 0 shows only the total")
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	Fsck = cobra.Command{
+		Use:   "fsck PATH [--repair]",
+		Short: "check the ramdisk's snapshots and mounts for consistency",
+		Long: `
+check the ramdisk's snapshots and mounts for consistency
+
+The snapshots state is checked and cross-checked against the eph root:
+
+* a corrupt snapshots state, which is checked using its backup instead
+* snapshot images that are missing from the state, or the other way round
+* snapshots depending on each other in a cycle, or on missing snapshots
+* stale snapshot mounts that HEAD doesn't use
+* HEAD that isn't mounted, or doesn't match the applied snapshot
+* the overlay not being mounted, or mounted with other layers than
+  the ones in eph root
+
+Each problem is printed along with what --repair does about it. Only
+the problems that can be fixed without losing any data are repaired:
+orphaned snapshot images left behind by an interrupted snapshot new are
+removed, stale mounts are unmounted, HEAD and the overlay are mounted if
+they aren't, and the state is restored from its backup if it's corrupt
+and updated to match the snapshot HEAD shows. The rest has to be fixed
+by hand. fsck exits with an error if there are problems left.
+`,
+		Example: `
+# Check /foo/bar and repair what can be repaired
+eph fsck /foo/bar --repair
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkPathArg(args); err != nil {
+				return err
+			}
+
+			if err := eph.Fsck(absPath(stripTrailingSlash(args[0])), fsckRepair); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	fsckRepair bool
+)
+
+func init() {
+	Fsck.PersistentFlags().BoolVar(&fsckRepair, "repair", false, "fix the problems that can be fixed without losing any data")
+}
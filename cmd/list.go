@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	List = cobra.Command{
+		Use:   "list",
+		Short: "list all ramdisks on this host",
+		Long: `
+list all ramdisks on this host
+
+Ramdisks are found among the mounted filesystems, so the ones created
+with --eph-root are listed as well. For each one, its target location,
+eph root, quota and usage, the applied snapshot and the number of snapshots
+are shown, along with its health: "ok", or a list of the problems found:
+
+* overlay-unmounted   the ramdisk isn't mounted over its target location,
+                      e.g. after a failed merge
+* staging-unmounted   the tmpfs holding the ramdisk's data isn't mounted
+* head-unmounted      the original data isn't mounted in eph root
+* snapshot-unmounted  some of the applied snapshots aren't mounted
+* state-unreadable    the snapshots state can't be read
+* merge-in-progress   a merge has been interrupted, resume or abort it
+* full                there's no space left in the ramdisk
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("unexpected argument %s", args[0])
+			}
+
+			if err := eph.PrintRamdisks(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+)
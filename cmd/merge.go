@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gman0/eph/pkg/eph"
 	"github.com/spf13/cobra"
@@ -9,19 +10,117 @@ import (
 
 var (
 	Merge = cobra.Command{
-		Use:   "merge PATH",
+		Use:   "merge PATH [-- SUBPATH...]",
 		Short: "merge ramdisk and unmount",
 		Long: `
 merge ramdisk and close ramdisk
 
 Ramdisk is merged into the original data and then it's unmounted'.
+
+The merge is transactional: new versions of the changed files are first
+copied next to the original data, and only then renamed into place.
+Progress is recorded in a journal in eph root. Should the merge fail
+or get interrupted, it can be finished with --resume, or reverted with
+--abort, which restores the original data and mounts the ramdisk back.
+SIGINT and SIGTERM stop the merge once the files being copied are
+finished, leaving it ready to be resumed. The progress of copying
+is shown if stderr is a terminal.
+
+Unless --no-backup is specified, all original files that are about to be
+overwritten or deleted are backed up into a squashfs image first. The merge
+can then be reverted with the undo-merge command.
+
+Use --dry-run to only list the changes that would be merged along with
+their sizes. --plan additionally saves the list into a plan file, which
+can be reviewed and merged later with --apply-plan. Applying a plan is
+refused if the ramdisk has changed since the plan was made.
+
+Only some of the changes can be merged by listing their paths, relative
+to PATH, after --. Paths matching any of the --exclude glob patterns are
+left out of the merge. Patterns are matched against both the relative
+path and the file name. In both cases the ramdisk stays mounted and only
+the merged changes are dropped from it, the rest stays in the ramdisk.
+
+Files ignored by .ephignore or --ignore are never merged.
+
+--into writes the changes into another directory instead, e.g. a release
+tree or another checkout of the same project. The original data and
+the ramdisk are left untouched, the ramdisk may be discarded afterwards.
+Changes are applied to whatever the directory contains: files missing
+there are added, and deletions of files that don't exist are skipped.
+Backups of the overwritten data are stored next to the directory.
+
+The source directory of a ramdisk created with --target stays writable
+and may be modified while the ramdisk is in use. Its state is recorded
+when the ramdisk is created, and the paths changed both in the source
+directory and in the ramdisk are reported as conflicts. --strategy
+decides what happens with them: "fail" refuses to merge, "ours"
+overwrites them with the ramdisk's version and "theirs" keeps
+the source directory's version and leaves them out of the merge.
+
+--checksum compares files copied up into the ramdisk against the original
+data, as "eph status --content" does, and leaves out the unchanged ones.
+`,
+		Example: `
+# Review the changes before merging /foo/bar
+eph merge /foo/bar --plan bar-plan.json
+eph merge /foo/bar --apply-plan bar-plan.json
+
+# Merge only src/ and README.md, leaving out object files
+eph merge /foo/bar --exclude '*.o' -- src README.md
+
+# Apply the changes to another checkout
+eph merge /foo/bar --into /foo/bar-release
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			mergeOpts.Paths = nil
+			if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+				mergeOpts.Paths = args[dash:]
+				args = args[:dash]
+
+				if len(mergeOpts.Paths) == 0 {
+					return errors.New("missing paths to merge after --")
+				}
+			}
+
 			if err := checkPathArg(args); err != nil {
 				return err
 			}
 
-			if err := eph.Merge(stripTrailingSlash(args[0])); err != nil {
+			if mergeResume && mergeAbort {
+				return errors.New("--resume and --abort are mutually exclusive")
+			}
+
+			if (mergeResume || mergeAbort) && (mergeOpts.DryRun || mergeOpts.PlanFile != "" || mergeOpts.ApplyPlanFile != "") {
+				return errors.New("--resume and --abort can't be used with a merge plan")
+			}
+
+			if (mergeResume || mergeAbort) && (len(mergeOpts.Paths) > 0 || len(mergeOpts.Exclude) > 0 || mergeOpts.Into != "") {
+				return errors.New("--resume and --abort can't be used with paths to merge, --exclude or --into")
+			}
+
+			if mergeOpts.Into != "" {
+				mergeOpts.Into = absPath(stripTrailingSlash(mergeOpts.Into))
+			}
+
+			if mergeOpts.ApplyPlanFile != "" && (mergeOpts.DryRun || mergeOpts.PlanFile != "") {
+				return errors.New("--apply-plan can't be used with --dry-run or --plan")
+			}
+
+			// Plans are matched against absolute paths
+			p := absPath(stripTrailingSlash(args[0]))
+
+			var err error
+			switch {
+			case mergeResume:
+				err = eph.ResumeMerge(p)
+			case mergeAbort:
+				err = eph.AbortMerge(p)
+			default:
+				err = eph.Merge(p, mergeOpts)
+			}
+
+			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
@@ -29,4 +128,21 @@ Ramdisk is merged into the original data and then it's unmounted'.
 			return nil
 		},
 	}
+
+	mergeResume bool
+	mergeAbort  bool
+	mergeOpts   eph.MergeOptions
 )
+
+func init() {
+	Merge.PersistentFlags().BoolVar(&mergeResume, "resume", false, "resume an interrupted merge")
+	Merge.PersistentFlags().BoolVar(&mergeAbort, "abort", false, "abort an interrupted merge and restore the original data")
+	Merge.PersistentFlags().BoolVar(&mergeOpts.NoBackup, "no-backup", false, "don't back up the original data overwritten by the merge")
+	Merge.PersistentFlags().BoolVar(&mergeOpts.DryRun, "dry-run", false, "only list the changes that would be merged")
+	Merge.PersistentFlags().StringVar(&mergeOpts.PlanFile, "plan", "", "write the list of changes into a plan file instead of merging")
+	Merge.PersistentFlags().StringVar(&mergeOpts.ApplyPlanFile, "apply-plan", "", "merge only if the changes match the plan file")
+	Merge.PersistentFlags().StringVar(&mergeOpts.Strategy, "strategy", eph.StrategyFail, "resolve conflicts with changes in the source directory of a --target ramdisk: ours, theirs or fail")
+	Merge.PersistentFlags().StringVar(&mergeOpts.Into, "into", "", "write the changes into this directory instead, keeping the ramdisk")
+	Merge.PersistentFlags().BoolVar(&mergeOpts.Checksum, "checksum", false, "compare contents of files and leave out the unchanged ones")
+	Merge.PersistentFlags().StringArrayVar(&mergeOpts.Exclude, "exclude", nil, "glob pattern of paths to leave out of the merge, may be repeated")
+}
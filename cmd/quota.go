@@ -25,7 +25,14 @@ var (
 				return errors.New("invalid quota format")
 			}
 
-			if err := eph.SetQuota(stripTrailingSlash(args[0]), setQuota); err != nil {
+			p := stripTrailingSlash(args[0])
+
+			if err := eph.SetQuota(p, setQuota); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			if err := eph.PrintQuota(p); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	Recover = cobra.Command{
+		Use:   "recover [PATH|--all|--boot]",
+		Short: "put the original data back after the ramdisk has been lost",
+		Long: `
+put the original data back after the ramdisk has been lost
+
+After a reboot or a crash, the contents of the ramdisk are gone, while
+the original data still sits in its eph root and the target location is
+an empty mount point. recover moves the original data back in place and
+removes the leftover mount points, symlinks and the eph root. Eph roots
+left behind by a create that failed to roll back are cleaned up as well.
+
+A merge that was interrupted along with the ramdisk is finished if all
+of its changes have already been copied next to the original data, or
+aborted otherwise.
+
+Ramdisks are registered in /var/lib/eph/roots when they're created,
+failing to do so only prints a warning. --all recovers all registered
+ramdisks that are no longer mounted, along with unregistered ones whose
+ramdisk is still mounted.
+--boot does the same and prints only what has been done, it's meant
+to be run at boot by the eph-recover systemd unit.
+`,
+		Example: `
+# Recover /foo/bar after a reboot
+eph recover /foo/bar
+
+# Recover all ramdisks lost in a crash
+eph recover --all
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var p string
+
+			if recoverOpts.All || recoverOpts.Boot {
+				if len(args) != 0 {
+					return errors.New("--all and --boot can't be used with a path")
+				}
+			} else {
+				if err := checkPathArg(args); err != nil {
+					return err
+				}
+
+				p = absPath(stripTrailingSlash(args[0]))
+			}
+
+			if err := eph.Recover(p, recoverOpts); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	recoverOpts eph.RecoverOptions
+)
+
+func init() {
+	Recover.PersistentFlags().BoolVarP(&recoverOpts.All, "all", "a", false, "recover all registered ramdisks that are no longer mounted")
+	Recover.PersistentFlags().BoolVar(&recoverOpts.Boot, "boot", false, "recover all registered ramdisks, printing only what has been done; for use at boot")
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	Revert = cobra.Command{
+		Use:   "revert PATH SUBPATH...",
+		Short: "throw away changes to selected files and directories",
+		Long: `
+throw away changes to selected files and directories
+
+The listed paths, relative to PATH, are brought back to their original
+state: added files are removed, modified files and directories get their
+original contents back, and deleted ones reappear. Directories are reverted
+along with all of their contents, a renamed directory reappears under its
+old name. Changes stored in snapshots are kept,
+the paths are reverted to their state in the applied snapshot.
+
+The ramdisk is briefly remounted afterwards, which invalidates all inodes
+in the target location. Make sure all files and directories in there
+are closed.
+`,
+		Example: `
+# Throw away changes to a config file and everything in build/
+eph revert /foo/bar etc/app.conf build
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("missing path")
+			}
+
+			if len(args) == 1 {
+				return errors.New("missing paths to revert")
+			}
+
+			if args[0] == layout.BaseOverride {
+				return errors.New("eph root collision")
+			}
+
+			// The overlay is remounted without the reverted paths, by layer
+			// paths that have to be absolute for eph list and eph fsck
+			// to find them in mountinfo
+			if err := eph.Revert(absPath(stripTrailingSlash(args[0])), args[1:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+)
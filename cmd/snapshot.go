@@ -35,6 +35,8 @@ eph snapshot apply /foo/bar --id 1
 create a new snapshot
 
 Create a snapshot of the current state of the ramdisk.
+Files ignored by .ephignore or --ignore are left out,
+they stay in the ramdisk when a snapshot is applied.
 
 Note that the snapshot is stored inside the ramdisk and
 contributes to the overall allocated space.
@@ -54,10 +56,13 @@ Important: make sure no writes occur to the ramdisk while
 				os.Exit(1)
 			}
 
-			fmt.Println(snapId)
+			if err = eph.PrintNewSnapshot(snapId); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 
 			if snapshotNewAndApply {
-				if err = eph.ApplySnapshot(args[0], snapId); err != nil {
+				if err = eph.ApplySnapshot(absPath(stripTrailingSlash(args[0])), snapId); err != nil {
 					fmt.Fprintf(os.Stderr, "failed to apply the snapshot: %v", err)
 					os.Exit(1)
 				}
@@ -140,7 +145,10 @@ This operation requires overlay remount.
 				return err
 			}
 
-			if err := eph.ApplySnapshot(stripTrailingSlash(args[0]), snapshotId); err != nil {
+			// The overlay is remounted on top of the snapshot. mountinfo lists
+			// its layers by the paths given, eph list and eph fsck can
+			// only match absolute ones to the ramdisk.
+			if err := eph.ApplySnapshot(absPath(stripTrailingSlash(args[0])), snapshotId); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
@@ -18,17 +18,40 @@ Each line consists of status code and object path relative to the specified path
 
 Status codes:
 * M modified
+* P only permissions, ownership or extended attributes modified
 * A added
 * D deleted
+* R renamed, printed as "R old -> new"
 
-Lowercase M,A,D status codes are used for directories, uppercase for all non-directories.
+Lowercase M,P,A,D,R status codes are used for directories, uppercase for all non-directories.
+
+Renamed directories are only recognized on overlays mounted with redirect_dir=on.
+Moved files are recognized by the origin file handle OverlayFS stores when copying
+them up, or by having the same size and contents as a deleted file.
+
+Files that have been copied up into the ramdisk, e.g. by touch or by an editor
+saving the same contents, are reported as modified. With --content, they are
+compared against the original data by their size, modification time and
+contents, and the ones that haven't changed are left out.
+
+Files matching the patterns in .ephignore in the root of PATH, or given with
+--ignore, are left out as well.
+
+With --watch, the current status is printed first, followed by changes
+made to the ramdisk as they happen, until it's unmounted or the command is
+interrupted. Only the changed paths are checked again, found with inotify
+on the ramdisk's upper layer. Each path whose status has changed is printed
+again, paths that no longer differ from the original data are printed with
+a "-" status code. In JSON output, each change is printed as a separate
+JSON document on a single line. The later ones have "event" set to "add",
+"modify" or "delete". Renames are only recognized in the initial status.
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if err := checkPathArg(args); err != nil {
 				return err
 			}
 
-			if err := eph.PrintStatus(stripTrailingSlash(args[0])); err != nil {
+			if err := eph.PrintStatus(stripTrailingSlash(args[0]), statusOpts); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
@@ -36,4 +59,11 @@ Lowercase M,A,D status codes are used for directories, uppercase for all non-dir
 			return nil
 		},
 	}
+
+	statusOpts eph.StatusOptions
 )
+
+func init() {
+	Status.PersistentFlags().BoolVar(&statusOpts.Content, "content", false, "compare contents of files and leave out the unchanged ones")
+	Status.PersistentFlags().BoolVarP(&statusOpts.Watch, "watch", "w", false, "keep printing changes as they are made")
+}
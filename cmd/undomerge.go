@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/eph"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	UndoMerge = cobra.Command{
+		Use:   "undo-merge PATH",
+		Short: "revert a merge",
+		Long: `
+revert a merge using its backup
+
+The original data overwritten or deleted by a merge is restored from the
+backup image, and all files added by the merge are removed. By default,
+the most recent merge is reverted. The backup is removed afterwards.
+Older merges can be reverted only once the later ones into the same
+directory are undone, unless --force is used.
+
+Backups are stored next to PATH, e.g. /foo/.eph-backup.bar for /foo/bar.
+
+PATH must not be an active ramdisk. Backups made by commit or by merging
+only selected paths, which keep the ramdisk mounted, can be undone once
+the ramdisk has been discarded: the changes made since are dropped along
+with it and orig, holding the merged changes, is put back in PATH.
+
+Important: 'squashfs-tools' must be installed on the system and accessible
+           from $PATH in order for backups to function
+`,
+		Example: `
+# Merge a ramdisk in /foo/bar and change your mind afterwards
+eph merge /foo/bar
+eph undo-merge /foo/bar
+
+# Undo a commit
+eph discard /foo/bar
+eph undo-merge /foo/bar
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkPathArg(args); err != nil {
+				return err
+			}
+
+			if err := eph.UndoMerge(stripTrailingSlash(args[0]), undoMergeBackupId, undoMergeForce); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	undoMergeBackupId int
+	undoMergeForce    bool
+)
+
+func init() {
+	UndoMerge.PersistentFlags().IntVarP(&undoMergeBackupId, "id", "i", 0, "backup ID; defaults to the most recent backup")
+	UndoMerge.PersistentFlags().BoolVarP(&undoMergeForce, "force", "f", false, "undo a merge even if a later merge into the same directory hasn't been undone")
+}
@@ -4,5 +4,5 @@ go 1.12
 
 require (
 	github.com/spf13/cobra v0.0.5
-	golang.org/x/sys v0.0.0-20181205085412-a5c9d58dba9a
+	golang.org/x/sys v0.7.0
 )
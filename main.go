@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gman0/eph/cmd"
+	"github.com/gman0/eph/pkg/ignore"
 	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"github.com/gman0/eph/pkg/output"
 	"github.com/spf13/cobra"
 	"os"
 	"strings"
@@ -18,6 +21,9 @@ func main() {
 eph (ephemeral) is a ramdisk management tool for Linux
 	`,
 		Version: "WIP",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return output.Check()
+		},
 	}
 
 	completion := cobra.Command{
@@ -47,14 +53,28 @@ eph (ephemeral) is a ramdisk management tool for Linux
 	}
 
 	rootCmd.AddCommand(&cmd.Create)
+	rootCmd.AddCommand(&cmd.List)
 	rootCmd.AddCommand(&cmd.Status)
+	rootCmd.AddCommand(&cmd.Diff)
+	rootCmd.AddCommand(&cmd.Revert)
 	rootCmd.AddCommand(&cmd.Discard)
 	rootCmd.AddCommand(&cmd.Merge)
+	rootCmd.AddCommand(&cmd.Commit)
+	rootCmd.AddCommand(&cmd.UndoMerge)
+	rootCmd.AddCommand(&cmd.Recover)
+	rootCmd.AddCommand(&cmd.Fsck)
 	rootCmd.AddCommand(&cmd.Snapshot)
 	rootCmd.AddCommand(&cmd.SetQuota)
+	rootCmd.AddCommand(&cmd.Du)
 	rootCmd.AddCommand(&completion)
 
 	rootCmd.PersistentFlags().StringVarP(&layout.BaseOverride, "eph-root", "r", "", "override default eph root location")
+	rootCmd.PersistentFlags().StringVar(&output.Format, "output", output.Text, "output format; available text, porcelain, json")
+	rootCmd.PersistentFlags().BoolVarP(&output.NulTerminated, "null", "z", false, "terminate porcelain records with NUL instead of newline and don't quote paths; implies --output porcelain")
+	rootCmd.PersistentFlags().StringArrayVar(&ignore.Patterns, "ignore", nil, "ignore files matching a gitignore-style pattern, in addition to .ephignore; may be repeated")
+	rootCmd.PersistentFlags().BoolVar(&ignore.Gitignore, "gitignore", false, "use .gitignore when there's no .ephignore")
+	rootCmd.PersistentFlags().BoolVar(&lock.Wait, "wait", false, "wait for other eph processes to release the ramdisk instead of failing")
+	rootCmd.PersistentFlags().DurationVar(&lock.Timeout, "timeout", 0, "wait at most this long for other eph processes to release the ramdisk, e.g. 30s; implies --wait")
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
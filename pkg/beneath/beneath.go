@@ -0,0 +1,91 @@
+// Package beneath resolves paths beneath a directory without following
+// symlinks, so that a concurrently modified directory tree can't redirect
+// file operations outside of it.
+package beneath
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// Root is a directory all paths are resolved beneath.
+type Root struct {
+	f *os.File
+}
+
+// Open opens dir as a root. dir itself may be a symlink.
+func Open(dir string) (*Root, error) {
+	f, err := os.OpenFile(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Root{f: f}, nil
+}
+
+func (r *Root) Close() error {
+	return r.f.Close()
+}
+
+// OpenDir opens a directory beneath the root. None of the components
+// of relPath may be a symlink. O_NOFOLLOW is left out, RESOLVE_NO_SYMLINKS
+// covers the last component too and reports it as ELOOP, not ENOTDIR.
+func (r *Root) OpenDir(relPath string) (*os.File, error) {
+	var (
+		rel   = strings.TrimPrefix(path.Clean("/"+relPath), "/")
+		flags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC
+		name  = path.Join(r.f.Name(), rel)
+	)
+
+	if rel == "" {
+		rel = "."
+	}
+
+	fd, err := unix.Openat2(int(r.f.Fd()), rel, &unix.OpenHow{
+		Flags:   uint64(flags),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+
+	switch err {
+	case nil:
+		return os.NewFile(uintptr(fd), name), nil
+	case unix.ENOSYS:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("openat2 is not supported by the kernel, Linux 5.6 or newer is required")}
+	case unix.ELOOP, unix.EXDEV:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("path contains a symlink or escapes %s", r.f.Name())}
+	}
+
+	return nil, &os.PathError{Op: "open", Path: name, Err: err}
+}
+
+// FdPath returns a path through which the opened directory can be accessed
+// regardless of it being renamed or replaced by a symlink.
+func FdPath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// Chmod changes the mode of p without following it if it's a symlink.
+func Chmod(p string, mode os.FileMode) error {
+	fd, err := unix.Open(p, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: p, Err: err}
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "chmod", Path: p, Err: err}
+	}
+
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return &os.PathError{Op: "chmod", Path: p, Err: unix.ELOOP}
+	}
+
+	// The magic link is resolved to the opened inode itself
+	return os.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), mode)
+}
@@ -0,0 +1,39 @@
+package device
+
+import (
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// Large enough for the file handles of any filesystem
+const maxHandleSize = 128
+
+// fileHandle is struct file_handle of name_to_handle_at(2)
+type fileHandle struct {
+	bytes      uint32
+	handleType int32
+	handle     [maxHandleSize]byte
+}
+
+// FileHandle returns the file handle identifying file p on its filesystem,
+// see name_to_handle_at(2). Symlinks are not followed.
+func FileHandle(p string) (handleType int32, handle []byte, err error) {
+	pathPtr, err := unix.BytePtrFromString(p)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		fh      = fileHandle{bytes: maxHandleSize}
+		mntId   int32
+		atFdcwd = unix.AT_FDCWD
+	)
+
+	_, _, errno := unix.Syscall6(unix.SYS_NAME_TO_HANDLE_AT, uintptr(atFdcwd), uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&fh)), uintptr(unsafe.Pointer(&mntId)), 0, 0)
+	if errno != 0 {
+		return 0, nil, errno
+	}
+
+	return fh.handleType, fh.handle[:fh.bytes], nil
+}
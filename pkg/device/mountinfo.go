@@ -0,0 +1,99 @@
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mount is a line of /proc/self/mountinfo, see proc(5)
+type Mount struct {
+	MountPoint string
+	FsType     string
+	Source     string
+	// Options are the per-superblock options, e.g. the layers of an overlay
+	Options map[string]string
+}
+
+// Mounts lists the filesystems mounted in the mount namespace of the process
+func Mounts() ([]Mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		mounts []Mount
+		s      = bufio.NewScanner(f)
+	)
+
+	for s.Scan() {
+		m, err := parseMountInfo(s.Text())
+		if err != nil {
+			return nil, err
+		}
+
+		mounts = append(mounts, m)
+	}
+
+	return mounts, s.Err()
+}
+
+func parseMountInfo(line string) (Mount, error) {
+	fields := strings.Fields(line)
+
+	// Optional fields are terminated by a single hyphen
+	sep := 6
+	for sep < len(fields) && fields[sep] != "-" {
+		sep++
+	}
+
+	if len(fields) < 5 || sep+3 >= len(fields) {
+		return Mount{}, fmt.Errorf("malformed mountinfo line: %s", line)
+	}
+
+	m := Mount{
+		MountPoint: unescapeMountInfo(fields[4]),
+		FsType:     fields[sep+1],
+		Source:     unescapeMountInfo(fields[sep+2]),
+		Options:    make(map[string]string),
+	}
+
+	for _, opt := range strings.Split(fields[sep+3], ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) == 2 {
+			m.Options[kv[0]] = unescapeMountInfo(kv[1])
+		} else {
+			m.Options[kv[0]] = ""
+		}
+	}
+
+	return m, nil
+}
+
+// unescapeMountInfo decodes the octal escapes of spaces, tabs, newlines,
+// backslashes and commas in mountinfo fields
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
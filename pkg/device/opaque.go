@@ -4,14 +4,71 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-const opaqueXAttr = "trusted.overlay.opaque"
+const (
+	opaqueXAttr   = "trusted.overlay.opaque"
+	redirectXAttr = "trusted.overlay.redirect"
+	originXAttr   = "trusted.overlay.origin"
 
+	// Layout of the file handle stored in the origin xattr:
+	// version, magic, length, flags, handle type, uuid, handle
+	originMagic     = 0xfb
+	originHeaderLen = 5 + 16
+)
+
+// IsOpaque checks whether directory p in an upper layer hides
+// the contents of the same directory in lower layers
 func IsOpaque(p string) (bool, error) {
 	var val [1]byte
-	_, err := unix.Getxattr(p, opaqueXAttr, val[:])
+	_, err := unix.Lgetxattr(p, opaqueXAttr, val[:])
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return false, nil
+	}
 	return val[0] == 'y', err
 }
 
 func RemoveOpaqueAttr(p string) error {
 	return unix.Removexattr(p, opaqueXAttr)
 }
+
+func RemoveRedirectAttr(p string) error {
+	return unix.Lremovexattr(p, redirectXAttr)
+}
+
+// getXattr reads xattr name of p. An empty value is returned if it's not set.
+func getXattr(p, name string) ([]byte, error) {
+	sz, err := unix.Lgetxattr(p, name, nil)
+	if err != nil || sz == 0 {
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	if sz, err = unix.Lgetxattr(p, name, buf); err != nil {
+		return nil, err
+	}
+
+	return buf[:sz], nil
+}
+
+// Redirect returns the path directory p in an upper layer was renamed from
+// with redirect_dir enabled, or an empty string if it wasn't renamed.
+// The path is either absolute, starting at the root of the layer,
+// or a name in the same parent directory.
+func Redirect(p string) (string, error) {
+	val, err := getXattr(p, redirectXAttr)
+	return string(val), err
+}
+
+// Origin returns the file handle of the lower layer file that file p
+// in an upper layer was copied up from. ok is false if it's not known.
+// The handle can be compared to the one returned by name_to_handle_at(2).
+func Origin(p string) (handleType int32, handle []byte, ok bool, err error) {
+	val, err := getXattr(p, originXAttr)
+	if err != nil || len(val) <= originHeaderLen || val[1] != originMagic {
+		return 0, nil, false, err
+	}
+
+	return int32(val[4]), val[originHeaderLen:], true, nil
+}
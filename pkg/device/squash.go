@@ -5,8 +5,15 @@ import (
 	"os/exec"
 )
 
-func Squash(src, dst, compressionAlg string) error {
-	cmd := exec.Command("mksquashfs", src, dst, "-comp", compressionAlg, "-no-progress")
+// Squash creates squashfs image dst out of directory src. Files listed
+// in excludeFile, one per line, are left out, unless it's empty.
+func Squash(src, dst, compressionAlg, excludeFile string) error {
+	args := []string{src, dst, "-comp", compressionAlg, "-no-progress"}
+	if excludeFile != "" {
+		args = append(args, "-ef", excludeFile)
+	}
+
+	cmd := exec.Command("mksquashfs", args...)
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
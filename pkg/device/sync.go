@@ -0,0 +1,17 @@
+package device
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// SyncFs commits all buffered data of the file-system containing p to disk.
+func SyncFs(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return unix.Syncfs(int(f.Fd()))
+}
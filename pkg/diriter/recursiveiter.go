@@ -1,6 +1,7 @@
 package diriter
 
 import (
+	"io"
 	"os"
 	"path"
 )
@@ -83,6 +84,9 @@ func (r *RecursiveIter) OrthogonalIncrement() {
 }
 
 func (r *RecursiveIter) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
 	return r.err
 }
 
@@ -0,0 +1,444 @@
+package eph
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/fscopy"
+	"github.com/gman0/eph/pkg/layout"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const backupCompressionAlg = "xz"
+
+// mergeBackup describes the previous versions of dirents overwritten
+// or deleted by a merge. The previous versions themselves are stored
+// in a squashfs image next to the backup manifest.
+type mergeBackup struct {
+	Created time.Time `json:"created"`
+	// Dest is the directory the merge was written into
+	Dest     string    `json:"dest"`
+	HasImage bool      `json:"has_image,omitempty"`
+	Ops      []mergeOp `json:"ops"`
+}
+
+func (b *mergeBackup) write(p string) error {
+	bs, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, bs, 0600)
+}
+
+func readMergeBackup(p string) (*mergeBackup, error) {
+	bs, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &mergeBackup{}
+
+	return b, json.Unmarshal(bs, b)
+}
+
+// A backup consists of these files, all of them
+// sharing the same prefix in layout.Backups
+func backupManifest(prefix string) string { return prefix + ".json" }
+func backupImage(prefix string) string    { return prefix + ".squash" }
+func backupTree(prefix string) string     { return prefix + ".tree" }
+func backupMount(prefix string) string    { return prefix + ".mount" }
+func backupUndo(prefix string) string     { return prefix + ".undo" }
+
+// newBackupPrefix creates layout.Backups(p) if needed and returns
+// a path prefix for a backup with the next available ID.
+func newBackupPrefix(p string) (string, error) {
+	backupsDir := layout.Backups(p)
+
+	if err := os.Mkdir(backupsDir, 0700); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create backups directory %s: %v", backupsDir, err)
+	}
+
+	ids, err := listBackups(backupsDir)
+	if err != nil {
+		return "", err
+	}
+
+	nextId := 1
+	if len(ids) > 0 {
+		nextId = ids[len(ids)-1] + 1
+	}
+
+	return path.Join(backupsDir, layout.MergeBackupName(nextId)), nil
+}
+
+// listBackups returns a sorted list of IDs of all backups found in backupsDir
+func listBackups(backupsDir string) ([]int, error) {
+	iter, err := diriter.NewIter(backupsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer iter.Close()
+
+	var ids []int
+
+	for ; !iter.AtEnd(); iter.Increment() {
+		name := iter.FileInfo().Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		id, err := layout.MergeBackupId(name)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	return ids, iter.Err()
+}
+
+// backup saves the current version of the op's target into the backup tree
+func (j *mergeJournal) backup(opIdx int) error {
+	var (
+		op  = &j.Ops[opIdx]
+		dst = path.Join(backupTree(j.Backup), op.Path)
+	)
+
+	if op.Kind == mergeAdd || op.Kind == mergeRename {
+		// Nothing is overwritten
+		return nil
+	}
+
+	target, err := j.resolve(op.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	if op.Kind == mergeAttr {
+		// Only the attributes of a directory are changed, its contents are left alone
+		info, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+
+		if err = os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+
+		if err = os.Lchown(dst, op.Uid, op.Gid); err != nil {
+			return err
+		}
+
+		if err = os.Chmod(dst, op.Mode); err != nil {
+			return err
+		}
+
+		st := info.Sys().(*syscall.Stat_t)
+		return os.Chtimes(dst, time.Unix(st.Atim.Unix()), info.ModTime())
+	}
+
+	if err := j.copier(false).Tree(target, dst); err != nil {
+		if err == fscopy.ErrInterrupted {
+			return err
+		}
+		return fmt.Errorf("failed to back up: %v", err)
+	}
+
+	return nil
+}
+
+// finishBackup squashes the backup tree and writes the backup manifest
+func (j *mergeJournal) finishBackup() error {
+	b := mergeBackup{
+		Created: time.Now(),
+		Dest:    j.BackupDest,
+		Ops:     make([]mergeOp, len(j.Ops)),
+	}
+
+	for i := range j.Ops {
+		b.Ops[i] = j.Ops[i]
+		b.Ops[i].Source = ""
+		b.Ops[i].SourceAttrs = nil
+	}
+
+	var (
+		tree  = backupTree(j.Backup)
+		image = backupImage(j.Backup)
+	)
+
+	hasTree, err := lexists(tree)
+	if err != nil {
+		return err
+	}
+
+	if hasTree {
+		// mksquashfs would append to an existing image
+		if err = os.Remove(image); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err = device.Squash(tree, image, backupCompressionAlg, ""); err != nil {
+			return fmt.Errorf("failed to create backup image %s (use --no-backup to merge without a backup): %v", image, err)
+		}
+
+		if err = os.RemoveAll(tree); err != nil {
+			return fmt.Errorf("failed to remove backup tree %s: %v", tree, err)
+		}
+
+		b.HasImage = true
+	}
+
+	if err = b.write(backupManifest(j.Backup)); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %v", err)
+	}
+
+	return nil
+}
+
+// discardBackup removes an incomplete backup of an aborted merge
+func (j *mergeJournal) discardBackup() error {
+	for _, p := range []string{backupTree(j.Backup), backupImage(j.Backup), backupManifest(j.Backup)} {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UndoMerge reverts the changes made by a merge using its backup.
+// If backupId is 0, the most recent backup is used. p must not be an active
+// ramdisk, merges that keep it mounted can be undone once it's discarded.
+// Unless force is set, only the most recent backup of the merged directory
+// can be used, undoing an older merge would leave the newer ones in place
+// on top of data they've never seen.
+func UndoMerge(p string, backupId int, force bool) error {
+	l, err := lockBackups(p)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	if exists, err := layout.PathShouldNotExist(layout.Base(p)); err != nil {
+		if exists {
+			return fmt.Errorf("%s is an active ramdisk, merges can't be undone until it's discarded with eph discard %s", p, p)
+		}
+		return err
+	}
+
+	backupsDir := layout.Backups(p)
+
+	ids, err := listBackups(backupsDir)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %v", err)
+	}
+
+	if len(ids) == 0 {
+		return fmt.Errorf("no merge backups found for %s", p)
+	}
+
+	if backupId == 0 {
+		backupId = ids[len(ids)-1]
+	}
+
+	var (
+		prefix      = path.Join(backupsDir, layout.MergeBackupName(backupId))
+		journalPath = backupUndo(prefix)
+		mountPoint  = backupMount(prefix)
+	)
+
+	b, err := readMergeBackup(backupManifest(prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("backup %d does not exist", backupId)
+		}
+		return fmt.Errorf("failed to read backup manifest: %v", err)
+	}
+
+	if !force {
+		// An interrupted undo is resumed regardless
+		resuming, err := lexists(journalPath)
+		if err != nil {
+			return err
+		}
+
+		if !resuming {
+			if err = checkNewestBackup(backupsDir, ids, backupId, b.Dest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.HasImage {
+		if err = os.Mkdir(mountPoint, 0700); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create backup mount point %s: %v", mountPoint, err)
+		}
+
+		if err = device.MountSquash(backupImage(prefix), mountPoint); err != nil {
+			return fmt.Errorf("failed to mount backup image: %v", err)
+		}
+
+		defer func() {
+			device.UnmountSquash(mountPoint)
+			os.Remove(mountPoint)
+		}()
+	}
+
+	// An interrupted undo is simply resumed
+	j, err := readMergeJournal(journalPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read undo journal: %v", err)
+		}
+
+		if j, err = b.undoJournal(mountPoint); err != nil {
+			return err
+		}
+
+		if err = j.write(journalPath); err != nil {
+			return fmt.Errorf("failed to write undo journal: %v", err)
+		}
+	}
+
+	if err = j.run(journalPath, ""); err != nil {
+		return fmt.Errorf("undo failed: %v\n  recovery:\n    resume: eph undo-merge %s --id %d", err, p, backupId)
+	}
+
+	for _, f := range []string{journalPath, backupManifest(prefix), backupImage(prefix)} {
+		if err = os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", f, err)
+		}
+	}
+
+	if remaining, err := listBackups(backupsDir); err == nil && len(remaining) == 0 {
+		// Still locked, undo-merges waiting for the lock notice it's gone
+		os.Remove(layout.BackupsLock(p))
+		os.Remove(backupsDir)
+	}
+
+	return nil
+}
+
+// checkNewestBackup makes sure none of the backups in backupsDir
+// made after backupId has been written into dest
+func checkNewestBackup(backupsDir string, ids []int, backupId int, dest string) error {
+	for _, id := range ids {
+		if id <= backupId {
+			continue
+		}
+
+		b, err := readMergeBackup(backupManifest(path.Join(backupsDir, layout.MergeBackupName(id))))
+		if err != nil {
+			return fmt.Errorf("failed to read manifest of backup %d: %v", id, err)
+		}
+
+		if b.Dest == dest {
+			return fmt.Errorf("backup %d of a later merge into %s exists, undo it first or use --force to undo backup %d anyway", id, dest, backupId)
+		}
+	}
+
+	return nil
+}
+
+// undoJournal inverts the backed up merge operations.
+// Previous versions of the dirents are read from the mounted backup image.
+//
+// Renames are reverted first, while the directories they were moved into
+// are still there. The other ops inside renamed directories refer to
+// the original paths, which they are moved back to.
+func (b *mergeBackup) undoJournal(imageMountPoint string) (*mergeJournal, error) {
+	var (
+		j = &mergeJournal{
+			Phase: mergePhaseStaging,
+			Dest:  b.Dest,
+			Ops:   make([]mergeOp, 0, len(b.Ops)),
+		}
+		renamedDirs = renamedDirOps(b.Ops)
+		others      []mergeOp
+	)
+
+	for i := range b.Ops {
+		if b.Ops[i].Kind != mergeRename {
+			continue
+		}
+
+		op := b.Ops[i]
+		op.Path, op.From = op.From, op.Path
+		// The original attributes are restored
+		op.Source = ""
+
+		j.Ops = append(j.Ops, op)
+	}
+
+	for i := range b.Ops {
+		if b.Ops[i].Nested {
+			// Reverted along with the shallow parent
+			continue
+		}
+
+		if b.Ops[i].Kind == mergeRename {
+			continue
+		}
+
+		op := mergeOp{
+			Path:   b.Ops[i].Path,
+			Source: path.Join(imageMountPoint, b.Ops[i].Path),
+		}
+
+		switch b.Ops[i].Kind {
+		case mergeAdd:
+			op.Kind = mergeDelete
+			op.Source = ""
+		case mergeReplace:
+			op.Kind = mergeReplace
+		case mergeDelete:
+			op.Kind = mergeAdd
+		case mergeAttr:
+			info, err := os.Lstat(path.Join(b.Dest, op.Path))
+			if err != nil {
+				return nil, err
+			}
+
+			st := info.Sys().(*syscall.Stat_t)
+			op.Kind = mergeAttr
+			op.Mode = info.Mode()
+			op.Uid = int(st.Uid)
+			op.Gid = int(st.Gid)
+		}
+
+		others = append(others, op)
+	}
+
+	j.Ops = append(j.Ops, others...)
+
+	for i := range j.Ops {
+		j.Ops[i].Path = origLocation(b.Ops, renamedDirs, j.Ops[i].Path)
+		if j.Ops[i].From != "" {
+			j.Ops[i].From = origLocation(b.Ops, renamedDirs, j.Ops[i].From)
+		}
+	}
+
+	return j, nil
+}
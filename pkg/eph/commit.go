@@ -0,0 +1,24 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/layout"
+)
+
+// Commit writes all changes stored in the ramdisk into orig,
+// and resets the ramdisk on top of the updated orig.
+func Commit(p string, opts MergeOptions) error {
+	return merge(p, opts, mergeModeCommit)
+}
+
+// finishCommit resets the ramdisk once its changes have been
+// written into orig. Snapshot layers are now part of orig as well,
+// so the overlay is mounted directly on top of orig.
+func finishCommit(p string) error {
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	return resetOverlay(p, ss, 0)
+}
@@ -0,0 +1,115 @@
+package eph
+
+import (
+	"bytes"
+	"github.com/gman0/eph/pkg/fscopy"
+	"io"
+	"os"
+	"syscall"
+)
+
+// sameMetadata compares permissions, ownership and extended attributes
+func sameMetadata(p1, p2 string, info1, info2 os.FileInfo) (bool, error) {
+	var (
+		st1 = info1.Sys().(*syscall.Stat_t)
+		st2 = info2.Sys().(*syscall.Stat_t)
+	)
+
+	if info1.Mode() != info2.Mode() || st1.Uid != st2.Uid || st1.Gid != st2.Gid {
+		return false, nil
+	}
+
+	xattrs1, err := fscopy.Xattrs(p1)
+	if err != nil {
+		return false, err
+	}
+
+	xattrs2, err := fscopy.Xattrs(p2)
+	if err != nil {
+		return false, err
+	}
+
+	if len(xattrs1) != len(xattrs2) {
+		return false, nil
+	}
+
+	for name, val := range xattrs1 {
+		if val2, ok := xattrs2[name]; !ok || !bytes.Equal(val, val2) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// sameContents compares two dirents of the same type. Regular files
+// of the same size and modification time are considered the same,
+// unless thorough is set, in which case files of the same size
+// are always compared byte by byte.
+func sameContents(p1, p2 string, info1, info2 os.FileInfo, thorough bool) (bool, error) {
+	switch {
+	case info1.Mode()&os.ModeSymlink != 0:
+		target1, err := os.Readlink(p1)
+		if err != nil {
+			return false, err
+		}
+
+		target2, err := os.Readlink(p2)
+		return target1 == target2, err
+	case !info1.Mode().IsRegular():
+		// Device nodes, FIFOs and sockets
+		return info1.Sys().(*syscall.Stat_t).Rdev == info2.Sys().(*syscall.Stat_t).Rdev, nil
+	}
+
+	if info1.Size() != info2.Size() {
+		return false, nil
+	}
+
+	if thorough {
+		// The modification time may have been preserved or reset
+		// by whatever changed the file, it can't be relied on
+		return sameFileContents(p1, p2)
+	}
+
+	return info1.ModTime().Equal(info2.ModTime()), nil
+}
+
+func sameFileContents(p1, p2 string) (bool, error) {
+	f1, err := os.Open(p1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+
+	f2, err := os.Open(p2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+
+	var (
+		buf1 = make([]byte, 64*1024)
+		buf2 = make([]byte, 64*1024)
+	)
+
+	for {
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
+
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+
+		if err1 != nil {
+			return false, err1
+		}
+
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
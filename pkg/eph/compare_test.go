@@ -0,0 +1,73 @@
+package eph
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSameContents(t *testing.T) {
+	var (
+		tmp   = tempDir(t)
+		mtime = time.Unix(1500000000, 0)
+	)
+
+	files := []struct {
+		name, data string
+		mtime      time.Time
+	}{
+		{"orig", "foo", mtime},
+		// Rewritten with the modification time restored
+		{"sameTime", "bar", mtime},
+		// Copied up and touched
+		{"sameData", "foo", mtime.Add(time.Second)},
+		{"longer", "fooo", mtime},
+	}
+
+	for _, f := range files {
+		p := path.Join(tmp, f.name)
+		mustWriteFile(t, p, f.data)
+
+		if err := os.Chtimes(p, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		thorough bool
+		same     bool
+	}{
+		{"sameTime", false, true},
+		{"sameTime", true, false},
+		{"sameData", false, false},
+		{"sameData", true, true},
+		{"longer", false, false},
+		{"longer", true, false},
+	}
+
+	origPath := path.Join(tmp, "orig")
+	origInfo, err := os.Lstat(origPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		p := path.Join(tmp, tt.name)
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		same, err := sameContents(p, origPath, info, origInfo, tt.thorough)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if same != tt.same {
+			t.Errorf("%s, thorough %v: same %v, expected %v", tt.name, tt.thorough, same, tt.same)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package eph
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"github.com/gman0/eph/pkg/udiff"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const (
+	// Files containing a NUL byte within the first binarySniffLen bytes
+	// are considered binary, the same way git does it
+	binarySniffLen = 8000
+	// Larger files are only reported as differing
+	maxDiffSize = 4 << 20
+)
+
+// differ prints unified diffs between files in orig
+// and their current versions in the overlay
+type differ struct {
+	w      *bufio.Writer
+	orig   string
+	head   string
+	filter *mergeFilter
+}
+
+// PrintDiff prints unified diffs of the changed files in ramdisk p
+// against their original versions. Binary files are only reported
+// as differing. If paths are given, only changes under them are shown.
+func PrintDiff(p string, paths []string) error {
+	var (
+		orig = layout.Orig(p)
+		base = layout.Base(p)
+	)
+
+	if err := checkTargetAndBaseDirs(p, base); err != nil {
+		return err
+	}
+
+	l, err := lockEph(p, lock.Shared)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	layers, err := snapshotLayers(ss, p)
+	if err != nil {
+		return err
+	}
+
+	ign, err := loadIgnore(layers, orig)
+	if err != nil {
+		return fmt.Errorf("failed to read ignore rules: %v", err)
+	}
+
+	filter, err := newMergeFilter(paths, nil, ign)
+	if err != nil {
+		return err
+	}
+
+	var (
+		d = differ{
+			w:      bufio.NewWriter(os.Stdout),
+			orig:   orig,
+			head:   p,
+			filter: filter,
+		}
+		changes []*change
+		rd      = renameDetector{orig: orig}
+	)
+
+	// Renames are known only once all changes have been found
+	err = walkChanges(layers, orig, false, func(c *change) error {
+		if d.visit(c) {
+			changes = append(changes, c)
+			rd.add(c)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	r, err := rd.detect()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		if err = d.change(c, r); err != nil {
+			break
+		}
+	}
+
+	if flushErr := d.w.Flush(); err == nil {
+		err = flushErr
+	}
+
+	return err
+}
+
+// visit decides which parts of the overlay are walked. false is returned
+// for dirents outside of the selected paths.
+func (d *differ) visit(c *change) bool {
+	if d.filter.ignored(c) {
+		c.prune = true
+		return false
+	}
+
+	selected, isAncestor := d.filter.match(c.relPath)
+	if !selected && !isAncestor {
+		c.prune = true
+		return false
+	}
+
+	if c.info.IsDir() && c.isWhole() {
+		// Children of added and replaced directories are walked as added,
+		// and the contents of orig's version are diffed against them
+		c.expand = true
+	}
+
+	return true
+}
+
+func (d *differ) change(c *change, r *renames) error {
+	selected, _ := d.filter.match(c.relPath)
+
+	if c.info.IsDir() {
+		if !c.isWhole() || c.origInfo == nil {
+			// Added, or inside another added or replaced directory
+			// whose orig contents have been taken care of already
+			return nil
+		}
+
+		if c.origInfo.IsDir() {
+			return d.origTree(c.relPath, c.origPath)
+		}
+
+		if !selected {
+			return nil
+		}
+
+		return d.diff(c.origPath, c.relPath, d.orig+c.origPath, "")
+	}
+
+	if !selected {
+		return nil
+	}
+
+	switch c.status {
+	case statusSkip, statusMetadata:
+		return nil
+	case statusDeleted:
+		if r.isGone(c.relPath) {
+			return nil
+		}
+
+		if c.origInfo.IsDir() {
+			return d.origTree(c.relPath, c.origPath)
+		}
+
+		return d.diff(c.origPath, c.relPath, d.orig+c.origPath, "")
+	}
+
+	if from := r.from[c.relPath]; from != nil {
+		return d.diff(from.origPath, c.relPath, d.orig+from.origPath, c.source)
+	}
+
+	if c.origInfo != nil && c.origInfo.IsDir() {
+		// A directory replaced by a non-directory
+		if err := d.origTree(c.relPath, c.origPath); err != nil {
+			return err
+		}
+
+		return d.diff(c.origPath, c.relPath, "", c.source)
+	}
+
+	oldPath := d.orig + c.origPath
+	if c.origInfo == nil {
+		// Dirents of added and replaced directories may still
+		// have their counterparts in orig
+		info, err := os.Lstat(oldPath)
+		if err != nil && !isNotExist(err) {
+			return err
+		}
+
+		if info == nil || info.IsDir() {
+			oldPath = ""
+		}
+	}
+
+	return d.diff(c.origPath, c.relPath, oldPath, c.source)
+}
+
+// origTree prints diffs of the files in orig's directory origPath, which
+// is relPath in the overlay, that are no longer in the overlay, or that
+// have become directories there. Files that are still there are diffed
+// when walking the overlay.
+func (d *differ) origTree(relPath, origPath string) error {
+	names, err := readOrigDirNames(d.orig + origPath)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var (
+			childPath     = relPath + "/" + name
+			childOrigPath = origPath + "/" + name
+		)
+
+		selected, isAncestor := d.filter.match(childPath)
+		if !selected && !isAncestor {
+			continue
+		}
+
+		info, err := os.Lstat(d.orig + childOrigPath)
+		if err != nil {
+			return err
+		}
+
+		overlayInfo, err := os.Lstat(d.head + childPath)
+		if err != nil {
+			if !isNotExist(err) {
+				return err
+			}
+			overlayInfo = nil
+		}
+
+		if info.IsDir() {
+			err = d.origTree(childPath, childOrigPath)
+		} else if selected && (overlayInfo == nil || overlayInfo.IsDir()) {
+			err = d.diff(childOrigPath, childPath, d.orig+childOrigPath, "")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readOrigDirNames(dir string) ([]string, error) {
+	iter, err := diriter.NewIter(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var names []string
+	for ; !iter.AtEnd(); iter.Increment() {
+		names = append(names, iter.FileInfo().Name())
+	}
+
+	if err = iter.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// diff prints the differences between files oldPath and newPath, whose
+// paths relative to orig and the overlay are oldRel and newRel. Either
+// of them may be empty for added and deleted files. Directories and
+// special files have no contents to compare.
+func (d *differ) diff(oldRel, newRel, oldPath, newPath string) error {
+	var (
+		aName = "a" + oldRel
+		bName = "b" + newRel
+	)
+
+	oldData, err := readDiffable(oldPath)
+	if err != nil {
+		return err
+	}
+
+	newData, err := readDiffable(newPath)
+	if err != nil {
+		return err
+	}
+
+	if oldData == nil {
+		oldPath, aName = "", "/dev/null"
+	}
+
+	if newData == nil {
+		newPath, bName = "", "/dev/null"
+	}
+
+	if oldPath == "" && newPath == "" {
+		return nil
+	}
+
+	if oldPath != "" && newPath != "" {
+		same := bytes.Equal(oldData, newData)
+		if same && len(oldData) > maxDiffSize {
+			// Only the beginnings of the files have been read
+			if same, err = sameFileContents(oldPath, newPath); err != nil {
+				return err
+			}
+		}
+
+		if same {
+			return nil
+		}
+	}
+
+	if isBinary(oldData) || isBinary(newData) {
+		_, err = fmt.Fprintf(d.w, "Binary files %s and %s differ\n", aName, bName)
+		return err
+	}
+
+	if len(oldData) == 0 && len(newData) == 0 {
+		// An empty file that's been added or deleted
+		_, err = fmt.Fprintf(d.w, "--- %s\n+++ %s\n", aName, bName)
+		return err
+	}
+
+	if len(oldData) > maxDiffSize || len(newData) > maxDiffSize {
+		_, err = fmt.Fprintf(d.w, "Files %s and %s differ\n", aName, bName)
+		return err
+	}
+
+	err = udiff.Write(d.w, aName, bName, udiff.Lines(oldData), udiff.Lines(newData))
+	if err == udiff.ErrTooManyChanges {
+		_, err = fmt.Fprintf(d.w, "Files %s and %s differ\n", aName, bName)
+	}
+
+	return err
+}
+
+// readDiffable reads the contents of a regular file or the target
+// of a symlink. nil is returned for other kinds of files. Files
+// too large to be diffed are read only up to maxDiffSize+1 bytes.
+func readDiffable(p string) ([]byte, error) {
+	if p == "" {
+		return nil, nil
+	}
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		data, err := ioutil.ReadAll(io.LimitReader(f, maxDiffSize+1))
+		if data == nil {
+			data = []byte{}
+		}
+
+		return data, err
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		return []byte(target), err
+	}
+
+	return nil, nil
+}
+
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLen {
+		data = data[:binarySniffLen]
+	}
+
+	return bytes.IndexByte(data, 0) >= 0
+}
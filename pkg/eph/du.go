@@ -0,0 +1,239 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"github.com/gman0/eph/pkg/output"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+)
+
+// diskUsage is the tmpfs space taken by the parts of a ramdisk, in bytes
+type diskUsage struct {
+	// Dirs are the directories of the upper layer up to the requested
+	// depth, children before their parents, ending with the root "."
+	Dirs      []dirUsage      `json:"dirs"`
+	Snapshots []snapshotUsage `json:"snapshots"`
+	Quota     quotaInfo       `json:"quota"`
+}
+
+type dirUsage struct {
+	Path  string `json:"path"`
+	Bytes uint64 `json:"bytes"`
+	// CopyUpBytes are taken by copies of files that exist in orig
+	// or in the applied snapshot, included in Bytes
+	CopyUpBytes uint64 `json:"copy_up_bytes"`
+}
+
+type snapshotUsage struct {
+	Id    int    `json:"id"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// duWalker sums up the space allocated to the dirents in diff
+type duWalker struct {
+	diff string
+	// lower are orig and the snapshot layers below diff
+	lower    []string
+	maxDepth int
+	dirs     []dirUsage
+	// Inodes of hardlinked files already counted
+	seen map[uint64]bool
+}
+
+// PrintDiskUsage prints how much space the directories in the upper layer
+// of ramdisk p take up to maxDepth levels deep, along with the snapshot
+// images and the share of copied-up files.
+func PrintDiskUsage(p string, maxDepth int) error {
+	if err := checkTargetAndBaseDirs(p, layout.Base(p)); err != nil {
+		return err
+	}
+
+	l, err := lockEph(p, lock.Shared)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	if maxDepth < 0 {
+		return fmt.Errorf("invalid depth %d", maxDepth)
+	}
+
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	layers, err := snapshotLayers(ss, p)
+	if err != nil {
+		return err
+	}
+
+	w := duWalker{
+		diff:     layout.OverlayDiff(p),
+		lower:    append([]string{layout.Orig(p)}, layers[:len(layers)-1]...),
+		maxDepth: maxDepth,
+		seen:     make(map[uint64]bool),
+	}
+
+	if _, _, err = w.walk("", 0); err != nil {
+		return fmt.Errorf("failed to measure %s: %v", w.diff, err)
+	}
+
+	du := diskUsage{Dirs: w.dirs}
+
+	ids := make([]int, 0, len(ss.Snapshots))
+	for id := range ss.Snapshots {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		info, err := os.Lstat(path.Join(layout.Snapshots(p), layout.SnapshotFilename(id)))
+		if err != nil {
+			return fmt.Errorf("failed to stat snapshot %d: %v", id, err)
+		}
+
+		du.Snapshots = append(du.Snapshots, snapshotUsage{id, allocatedBytes(info)})
+	}
+
+	if du.Quota, err = readQuota(layout.Staging(p)); err != nil {
+		return err
+	}
+
+	switch output.Format {
+	case output.JSON:
+		return output.WriteJSON(du)
+	case output.Porcelain:
+		w := output.NewWriter()
+
+		for _, d := range du.Dirs {
+			w.Record("dir", strconv.FormatUint(d.Bytes, 10), strconv.FormatUint(d.CopyUpBytes, 10), output.Quote(d.Path))
+		}
+		for _, s := range du.Snapshots {
+			w.Record("snapshot", strconv.Itoa(s.Id), strconv.FormatUint(s.Bytes, 10))
+		}
+		writeQuotaRecord(w, du.Quota)
+
+		return w.Flush()
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "SIZE\tCOPY-UPS\tPATH")
+	for _, d := range du.Dirs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", humanBytes(d.Bytes), humanBytes(d.CopyUpBytes), d.Path)
+	}
+
+	if len(du.Snapshots) > 0 {
+		fmt.Fprintln(tw, "")
+		fmt.Fprintln(tw, "SIZE\t\tSNAPSHOT")
+
+		for _, s := range du.Snapshots {
+			fmt.Fprintf(tw, "%s\t\t%d\n", humanBytes(s.Bytes), s.Id)
+		}
+	}
+
+	fmt.Fprintln(tw, "")
+	fmt.Fprintf(tw, "Used %s out of %s, %s available\n",
+		humanBytes(du.Quota.Used), humanBytes(du.Quota.Size), humanBytes(du.Quota.Available))
+
+	return tw.Flush()
+}
+
+// walk sums up the space taken by directory relPath in diff and its
+// contents, and records it if it's at most maxDepth levels deep
+func (w *duWalker) walk(relPath string, depth int) (bytes, copyUps uint64, err error) {
+	iter, err := diriter.NewIter(w.diff + relPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer iter.Close()
+
+	var infos []os.FileInfo
+	for ; !iter.AtEnd(); iter.Increment() {
+		infos = append(infos, iter.FileInfo())
+	}
+
+	if err = iter.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	for _, info := range infos {
+		childPath := relPath + "/" + info.Name()
+
+		if info.IsDir() {
+			childBytes, childCopyUps, err := w.walk(childPath, depth+1)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			bytes += childBytes
+			copyUps += childCopyUps
+		}
+
+		if w.counted(info) {
+			continue
+		}
+
+		size := allocatedBytes(info)
+		bytes += size
+
+		if info.IsDir() || size == 0 {
+			continue
+		}
+
+		isCopyUp, err := existsInLayers(w.lower, childPath)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if isCopyUp {
+			copyUps += size
+		}
+	}
+
+	if depth <= w.maxDepth {
+		p := "."
+		if relPath != "" {
+			p = relPath[1:]
+		}
+
+		w.dirs = append(w.dirs, dirUsage{p, bytes, copyUps})
+	}
+
+	return bytes, copyUps, nil
+}
+
+// counted reports whether info is a hardlink to a file already counted
+func (w *duWalker) counted(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 || info.IsDir() {
+		return false
+	}
+
+	if w.seen[st.Ino] {
+		return true
+	}
+
+	w.seen[st.Ino] = true
+	return false
+}
+
+// allocatedBytes is the space taken by the dirent in its filesystem,
+// which for sparse files may be less than their size
+func allocatedBytes(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Blocks) * 512
+	}
+
+	return uint64(info.Size())
+}
@@ -3,11 +3,11 @@ package eph
 import (
 	"fmt"
 	"github.com/gman0/eph/pkg/device"
-	"github.com/gman0/eph/pkg/diriter"
 	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
 	"github.com/gman0/eph/pkg/onerror"
+	"github.com/gman0/eph/pkg/output"
 	"os"
-	"os/exec"
 	"path"
 	"syscall"
 )
@@ -19,9 +19,16 @@ const (
 	statusModified                  = 'M'
 	statusAdded                     = 'A'
 	statusDeleted                   = 'D'
+	// Only the permissions, ownership or extended attributes have changed
+	statusMetadata = 'P'
+	// Moved from elsewhere, the original path is printed as well
+	statusRenamed = 'R'
 )
 
-func Create(source, targetOverride, size string) error {
+// Create mounts a new ramdisk over source, or over targetOverride if set.
+// The state of the source directory of a --target ramdisk is recorded
+// in a manifest, with file hashes if hashManifest is set.
+func Create(source, targetOverride, size string, hashManifest bool) error {
 	if isNotExist, err := layout.DirectoryShouldExist(source); err != nil {
 		if isNotExist {
 			return fmt.Errorf("target path %s does not exist", source)
@@ -78,20 +85,43 @@ func Create(source, targetOverride, size string) error {
 	var (
 		ss = SnapshotsState{}
 		st = info.Sys().(*syscall.Stat_t)
+		l  *lock.Lock
 	)
 
+	defer func() { l.Release() }()
+
 	do := onerror.Rollback{}
 
 	// Prepare ramdisk
 	do.
 		TryMkDir(base, 0755, "failed to create eph root").
+		Try(func() (err error) { l, err = lockEph(p, lock.Exclusive); return err }, func() { removeLock(base) }).
+		Try(func() error {
+			// The ramdisk is usable without it, list and recover find it among the mounts
+			if err := registerEph(p); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: failed to register eph root %s: %v\n", base, err)
+			}
+			return nil
+		}, func() { unregisterEph(base) }).
 		TryMkDir(staging, 0700).
 		TryMountRamdisk(staging, size, "failed to mount ramdisk").
 		Try(func() error { return mkDirs(0700, head, overlayDiff, overlayWorkdir, snapshotsBase, snapshotMounts) }, func() {}).
 		Try(func() error { return wrapE("failed to write snapshots state", ss.write(snapshotsState)) }, func() { os.Remove(snapshotsState) })
 
 	if targetOverride != "" {
-		do.TrySymlink(source, orig, "failed to symlink orig")
+		// The source directory remains writable, changes made there
+		// in the meantime are detected as conflicts when merging
+		manifestPath := layout.SourceManifest(p)
+
+		do.
+			Try(func() error {
+				m, err := recordSourceManifest(source, hashManifest)
+				if err == nil {
+					err = m.write(manifestPath)
+				}
+				return wrapE("failed to record source manifest", err)
+			}, func() { os.Remove(manifestPath) }).
+			TrySymlink(source, orig, "failed to symlink orig")
 	} else {
 		do.TryRename(p, orig, "failed to move orig")
 	}
@@ -112,7 +142,11 @@ func DiscardEphemeral(p string, noUnmount bool) error {
 		return err
 	}
 
-	var err error
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
 
 	defer func() {
 		if err != nil {
@@ -137,24 +171,58 @@ func DiscardEphemeral(p string, noUnmount bool) error {
 	return nil
 }
 
-func Merge(p string) error {
+func snapshotLayers(ss *SnapshotsState, p string) ([]string, error) {
+	snapshotMounts := layout.SnapshotMounts(p)
+	diff := layout.OverlayDiff(p)
+
+	var layers []string
+	if ss.AppliedSnapshot > 0 {
+		deps, err := snapshotDependencies(ss.AppliedSnapshot, ss)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshot dependencies: %v", err)
+		}
+
+		n := len(deps) + 2
+
+		layers = make([]string, n)
+
+		for i := range deps {
+			layers[n-i-3] = path.Join(snapshotMounts, layout.SnapshotMountpointTarget(deps[i]))
+		}
+
+		layers[n-2] = path.Join(snapshotMounts, layout.SnapshotMountpointTarget(ss.AppliedSnapshot))
+		layers[n-1] = diff
+	} else {
+		layers = []string{diff}
+	}
+
+	return layers, nil
+}
+
+type StatusOptions struct {
+	// Content compares the contents of files copied up into the ramdisk
+	// against orig, and leaves out the ones that haven't changed
+	Content bool
+	// Watch keeps printing changes made to the ramdisk once the current
+	// ones have been printed, see watchStatus
+	Watch bool
+}
+
+func PrintStatus(p string, opts StatusOptions) error {
 	var (
 		orig = layout.Orig(p)
 		base = layout.Base(p)
-		diff = layout.OverlayDiff(p)
 	)
 
 	if err := checkTargetAndBaseDirs(p, base); err != nil {
 		return err
 	}
 
-	if err := device.Unmount(p); err != nil {
-		return fmt.Errorf("failed to unmount overlay %s: %v", p, err)
-	}
-
-	if err := os.Remove(p); err != nil {
-		return fmt.Errorf("failed to remove overlay mount point %s: %v", p, err)
+	l, err := lockEph(p, lock.Shared)
+	if err != nil {
+		return err
 	}
+	defer l.Release()
 
 	ss, err := readSnapshotsState(layout.SnapshotsState(p))
 	if err != nil {
@@ -166,198 +234,216 @@ func Merge(p string) error {
 		return err
 	}
 
-	cp := func(from, to string) error {
-		cmd := exec.Command("cp", "--no-target-directory", "--recursive", "--no-dereference", "--preserve=all", from, to)
-		cmd.Stderr = os.Stderr
-		return cmd.Run()
+	ign, err := loadIgnore(layers, orig)
+	if err != nil {
+		return fmt.Errorf("failed to read ignore rules: %v", err)
 	}
 
-	doMerge := func() error {
-		for i := len(layers) - 1; i >= 0; i-- {
-			iter, err := diriter.NewRecursiveIter(layers[i])
-			if err != nil {
-				return err
-			}
-			defer iter.Close()
+	var (
+		changes []*change
+		rd      = renameDetector{orig: orig}
+	)
 
-			for !iter.AtEnd() {
-				stagingPath := path.Join(iter.Base(), iter.FileInfo().Name())
+	// Renames are known only once all changes have been found
+	err = walkChanges(layers, orig, opts.Content, func(c *change) error {
+		if isIgnored(ign, c) {
+			c.prune = true
+			return nil
+		}
 
-				isOlderVersion, err := compareLayerVersion(stagingPath, layers, i, iter.FileInfo())
-				if err != nil {
-					return err
-				}
+		changes = append(changes, c)
+		rd.add(c)
+		return nil
+	})
 
-				if isOlderVersion {
-					iter.OrthogonalIncrement()
-					continue
-				}
+	if err != nil {
+		return err
+	}
 
-				status, err := resolveChangeStatusCode(layers[i], orig, stagingPath, iter.FileInfo())
-				if err != nil {
-					return err
-				}
+	r, err := rd.detect()
+	if err != nil {
+		return err
+	}
 
-				printStatus(iter.FileInfo(), stagingPath, layers[i], status)
-
-				if status != statusSkip {
-					origPath := orig + stagingPath[len(layers[i]):]
-					switch status {
-					case statusAdded:
-						if iter.FileInfo().IsDir() {
-							if err := device.RemoveOpaqueAttr(stagingPath); err != nil {
-								return fmt.Errorf("failed to remove trusted.overlay.opaque xattr for %s: %v", stagingPath, err)
-							}
-						}
-						fallthrough
-					case statusModified:
-						if err := cp(stagingPath, origPath); err != nil {
-							return err
-						}
-					case statusDeleted:
-						if err := os.RemoveAll(origPath); err != nil {
-							return err
-						}
-					}
-				}
+	sp := newStatusPrinter(snapshotLayerIds(ss, p), opts.Watch)
+	if opts.Watch {
+		sp.known = make(map[string]watchedEntry)
+	}
 
-				iter.Increment()
-			}
+	for _, c := range changes {
+		switch {
+		case c.status == statusDeleted && r.isGone(c.relPath):
+		case c.status == statusRenamed:
+			sp.print(c, c.info, c.relPath, c.origPath, c.status)
+		case r.from[c.relPath] != nil:
+			sp.print(c, c.info, c.relPath, r.from[c.relPath].relPath, statusRenamed)
+		default:
+			sp.print(c, c.info, c.relPath, "", c.status)
 		}
 
-		return nil
+		for _, relPath := range r.hidden[c.relPath] {
+			sp.print(c, r.from[relPath].origInfo, relPath, r.from[relPath].relPath, statusRenamed)
+		}
 	}
 
-	if err := doMerge(); err != nil {
-		return fmt.Errorf("merge failed, the original data may have been modified: %v\n  recovery:\n    original data: %s\n    ramdisk diff:  %s", err, orig, diff)
+	if err = sp.flush(); err != nil || !opts.Watch {
+		return err
 	}
 
-	return destroyEph(p, false)
+	// Other commands aren't kept waiting for as long as the changes are watched
+	l.Release()
+
+	return watchStatus(p, opts, sp)
 }
 
-func compareLayerVersion(stagingPath string, layers []string, lowerLayerIdx int, stagingInfo os.FileInfo) (skip bool, err error) {
-	relPath := stagingPath[len(layers[lowerLayerIdx]):]
+// snapshotLayerIds maps the roots of snapshot layers to the snapshot IDs
+func snapshotLayerIds(ss *SnapshotsState, p string) map[string]int {
+	ids := make(map[string]int, len(ss.Snapshots))
 
-	// Look for an existing dirent in higher layers
-	// This is to make sure the i-th layer has the most
-	// recent version of the dirent at stagingPath.
-	for j := lowerLayerIdx + 1; j < len(layers); j++ {
-		if _, err := os.Lstat(layers[j] + relPath); err != nil {
-			if !os.IsNotExist(err) {
-				return false, err
-			}
-		} else {
-			// relPath exists in j-th layer, which means
-			// the i-th layer's relPath must be older than j-th layer's.
-			return true, nil
-		}
+	for id := range ss.Snapshots {
+		ids[path.Join(layout.SnapshotMounts(p), layout.SnapshotMountpointTarget(id))] = id
 	}
 
-	return false, nil
+	return ids
 }
 
-func snapshotLayers(ss *SnapshotsState, p string) ([]string, error) {
-	snapshotMounts := layout.SnapshotMounts(p)
-	diff := layout.OverlayDiff(p)
+func SetQuota(p, quota string) error {
+	if err := checkTargetAndBaseDirs(p, layout.Base(p)); err != nil {
+		return err
+	}
 
-	var layers []string
-	if ss.AppliedSnapshot > 0 {
-		deps, err := snapshotDependencies(ss.AppliedSnapshot, ss)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list snapshot dependencies: %v", err)
-		}
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
 
-		n := len(deps) + 2
+	return device.SetSize(layout.Staging(p), quota)
+}
 
-		layers = make([]string, n)
+// statusEntry is a single change listed by status in JSON output
+type statusEntry struct {
+	// Event is set for the changes reported by status --watch,
+	// see watchEvent
+	Event watchEvent `json:"event,omitempty"`
+	Code  string     `json:"code"`
+	Type  string     `json:"type"`
+	Path  string     `json:"path"`
+	// From is the original path of a renamed dirent
+	From string `json:"from,omitempty"`
+	Size int64  `json:"size"`
+	// Layer is the ID of the snapshot the change has been made in,
+	// 0 if it's been made since the applied snapshot
+	Layer int `json:"layer"`
+}
 
-		for i := range deps {
-			layers[n-i-3] = path.Join(snapshotMounts, layout.SnapshotMountpointTarget(deps[i]))
-		}
+// statusPrinter prints changes in the selected output format
+type statusPrinter struct {
+	w        *output.Writer
+	entries  []statusEntry
+	layerIds map[string]int
+	// streaming prints JSON entries one per line as they come
+	streaming bool
+	// known records the printed entries by their paths, if not nil
+	known map[string]watchedEntry
+}
 
-		layers[n-2] = path.Join(snapshotMounts, layout.SnapshotMountpointTarget(ss.AppliedSnapshot))
-		layers[n-1] = diff
-	} else {
-		layers = []string{diff}
+func newStatusPrinter(layerIds map[string]int, streaming bool) *statusPrinter {
+	sp := &statusPrinter{layerIds: layerIds, streaming: streaming}
+
+	switch output.Format {
+	case output.Porcelain:
+		sp.w = output.NewWriter()
+	case output.JSON:
+		sp.entries = []statusEntry{}
 	}
 
-	return layers, nil
+	return sp
 }
 
-func PrintStatus(p string) error {
-	var (
-		orig = layout.Orig(p)
-		base = layout.Base(p)
-	)
-
-	if err := checkTargetAndBaseDirs(p, base); err != nil {
-		return err
+// entry describes the change c, which is at relPath with info. from is
+// the original path of renamed dirents. Paths are relative to orig.
+// false is returned for changes that aren't listed.
+func (sp *statusPrinter) entry(c *change, info os.FileInfo, relPath, from string, status changeStatusCode) (watchedEntry, bool) {
+	if status == statusSkip {
+		return watchedEntry{}, false
 	}
 
-	ss, err := readSnapshotsState(layout.SnapshotsState(p))
-	if err != nil {
-		return fmt.Errorf("failed to read snapshots state: %v", err)
+	if info.IsDir() {
+		status ^= 0x20
 	}
 
-	layers, err := snapshotLayers(ss, p)
-	if err != nil {
-		return err
+	if from != "" {
+		from = from[1:]
 	}
 
-	for i := len(layers) - 1; i >= 0; i-- {
-		iter, err := diriter.NewRecursiveIter(layers[i])
-		if err != nil {
-			return err
-		}
-		defer iter.Close()
-
-		for !iter.AtEnd() {
-			stagingPath := path.Join(iter.Base(), iter.FileInfo().Name())
+	e := statusEntry{
+		Code:  string(rune(status)),
+		Path:  relPath[1:],
+		From:  from,
+		Layer: sp.layerIds[c.layer],
+	}
 
-			isOlderVersion, err := compareLayerVersion(stagingPath, layers, i, iter.FileInfo())
-			if err != nil {
-				return err
-			}
+	if status == statusDeleted {
+		// info is the whiteout
+		info = c.origInfo
+	}
 
-			if isOlderVersion {
-				iter.OrthogonalIncrement()
-				continue
-			}
+	e.Type, e.Size = output.FileType(info.Mode()), info.Size()
 
-			status, err := resolveChangeStatusCode(layers[i], orig, stagingPath, iter.FileInfo())
-			if err != nil {
-				return err
-			}
-
-			printStatus(iter.FileInfo(), stagingPath, layers[i], status)
+	return watchedEntry{e, info.ModTime()}, true
+}
 
-			if iter.FileInfo().IsDir() && status == statusAdded {
-				iter.OrthogonalIncrement()
-			} else {
-				iter.Increment()
-			}
+func (sp *statusPrinter) print(c *change, info os.FileInfo, relPath, from string, status changeStatusCode) {
+	if we, ok := sp.entry(c, info, relPath, from, status); ok {
+		if sp.known != nil {
+			sp.known[we.Path] = we
 		}
-	}
 
-	return nil
+		sp.write(we.statusEntry)
+	}
 }
 
-func SetQuota(p, quota string) error {
-	if err := checkTargetAndBaseDirs(p, layout.Base(p)); err != nil {
-		return err
+func (sp *statusPrinter) write(e statusEntry) {
+	code, from := e.Code, e.From
+	if e.Event == watchDelete {
+		// The dirent no longer differs from orig
+		code, from = "-", ""
 	}
 
-	return device.SetSize(layout.Staging(p), quota)
+	switch output.Format {
+	case output.Porcelain:
+		if from != "" {
+			sp.w.Rename(code, from, e.Path)
+		} else {
+			sp.w.Record(code, output.Quote(e.Path))
+		}
+	case output.JSON:
+		if sp.streaming {
+			output.WriteJSONLine(e)
+		} else {
+			sp.entries = append(sp.entries, e)
+		}
+	default:
+		if from != "" {
+			fmt.Printf("%s %s -> %s\n", code, from, e.Path)
+		} else {
+			fmt.Printf("%s %s\n", code, e.Path)
+		}
+	}
 }
 
-func printStatus(info os.FileInfo, stagingPath, basePath string, status changeStatusCode) {
-	if status != statusSkip {
-		if info.IsDir() {
-			status ^= 0x20
+func (sp *statusPrinter) flush() error {
+	switch output.Format {
+	case output.Porcelain:
+		return sp.w.Flush()
+	case output.JSON:
+		if !sp.streaming {
+			return output.WriteJSON(sp.entries)
 		}
-
-		fmt.Printf("%c %s\n", status, stagingPath[len(basePath)+1:])
 	}
+
+	return nil
 }
 
 func destroyEph(p string, noUnmount bool) error {
@@ -401,53 +487,116 @@ func destroyEph(p string, noUnmount bool) error {
 		}
 	}
 
+	if err := os.Remove(layout.SourceManifest(p)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove source manifest: %v", err)
+	}
+
+	if err := removeLock(base); err != nil {
+		return err
+	}
+
 	if err := os.Remove(base); err != nil {
 		return fmt.Errorf("failed to remove eph root %s: %v", base, err)
 	}
 
+	if err := unregisterEph(base); err != nil {
+		return fmt.Errorf("failed to unregister eph root %s: %v", base, err)
+	}
+
 	return nil
 }
 
-func resolveChangeStatusCode(overlayDiff, orig, stagingPath string, stagingInfo os.FileInfo) (changeStatusCode, error) {
-	if len(stagingPath) == len(overlayDiff) {
-		// We want to skip the first entry which is `diff`
-		// In this case, comparing the string lengths is sufficient to make sure the paths are equal
-		return statusSkip, nil
+// resolveChangeStatusCode compares the dirent against its version in orig.
+// Dirents in a fresh directory are added, as it replaces orig's version.
+// If content is set, files are compared by their contents as well.
+func resolveChangeStatusCode(orig string, c *change, fresh, content bool) error {
+	if fresh {
+		c.status = statusAdded
+		if device.IsWhiteout(c.info) {
+			c.status = statusSkip
+		}
+		return nil
 	}
 
-	var (
-		relPath    = stagingPath[len(overlayDiff):]
-		statusCode changeStatusCode
-	)
+	origInfo, err := os.Lstat(orig + c.origPath)
+	if err != nil {
+		if !isNotExist(err) {
+			return err
+		}
 
-	origInfo, statErr := os.Lstat(orig + relPath)
-	if statErr != nil && !os.IsNotExist(statErr) {
-		return statusSkip, statErr
+		// The parent may have been a non-directory in orig
+		origInfo = nil
 	}
 
-	if device.IsWhiteout(stagingInfo) {
+	c.origInfo = origInfo
+
+	switch {
+	case device.IsWhiteout(c.info):
 		// Upper layer contains a whiteout file.
 		// Two things may have caused this:
 		// (a) it exists in orig, which means the file has been removed
 		// (b) it doesn't exist in orig, the file existed only in ramdisk => ignore
-		if os.IsNotExist(statErr) {
-			statusCode = statusSkip
+		if origInfo == nil {
+			c.status = statusSkip
 		} else {
-			statusCode = statusDeleted
+			c.status = statusDeleted
 		}
-	} else {
-		if os.IsNotExist(statErr) {
-			statusCode = statusAdded
+	case origInfo == nil:
+		c.status = statusAdded
+	case c.info.IsDir() && origInfo.IsDir():
+		// Contents of orig's directory are merged into the overlay only
+		// if it's the lowest one found, otherwise they are hidden
+		last := c.dirs[len(c.dirs)-1]
+		c.replaced = last.root != orig || last.path != orig+c.origPath
+
+		if c.replaced {
+			c.status = statusModified
+			break
+		}
+
+		sameMeta, err := sameMetadata(c.source, orig+c.origPath, c.info, origInfo)
+		if err != nil {
+			return err
+		}
+
+		if sameMeta {
+			c.status = statusSkip
 		} else {
-			if stagingInfo.IsDir() && origInfo.IsDir() {
-				if stagingInfo.Mode().Perm() == origInfo.Mode().Perm() {
-					statusCode = statusSkip
-				}
-			} else {
-				statusCode = statusModified
-			}
+			c.status = statusMetadata
 		}
+	default:
+		return resolveFileStatusCode(orig, c, content)
+	}
+
+	return nil
+}
+
+// resolveFileStatusCode compares a non-directory against its version in orig.
+// Files copied up into the ramdisk keep their size and modification time,
+// so those are considered to have the same contents, unless content is set
+// and the contents are compared instead.
+func resolveFileStatusCode(orig string, c *change, content bool) error {
+	c.status = statusModified
+
+	if c.info.Mode()&os.ModeType != c.origInfo.Mode()&os.ModeType {
+		return nil
+	}
+
+	sameContents, err := sameContents(c.source, orig+c.origPath, c.info, c.origInfo, content)
+	if err != nil || !sameContents {
+		return err
 	}
 
-	return statusCode, nil
+	sameMeta, err := sameMetadata(c.source, orig+c.origPath, c.info, c.origInfo)
+	if err != nil {
+		return err
+	}
+
+	if !sameMeta {
+		c.status = statusMetadata
+	} else if content {
+		c.status = statusSkip
+	}
+
+	return nil
 }
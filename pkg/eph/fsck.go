@@ -0,0 +1,610 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"github.com/gman0/eph/pkg/output"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// fsckProblem is an inconsistency found by eph fsck
+type fsckProblem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Repair tells what --repair does about the problem. Empty if
+	// it can't be repaired safely and has to be fixed by hand.
+	Repair   string `json:"repair,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+type fsck struct {
+	p        string
+	repair   bool
+	ss       *SnapshotsState
+	mounted  map[string]device.Mount
+	problems []fsckProblem
+	// ssChanged is set when the snapshots state has been repaired
+	ssChanged bool
+}
+
+// Fsck cross-checks the snapshots state of ramdisk p against the snapshot
+// images and the mounts in its eph root. With repair set, problems that can
+// be fixed without losing any data are fixed. An error is returned if
+// there are problems left.
+func Fsck(p string, repair bool) error {
+	if err := checkTargetAndBaseDirs(p, layout.Base(p)); err != nil {
+		return err
+	}
+
+	lockMode := lock.Shared
+	if repair {
+		lockMode = lock.Exclusive
+	}
+
+	l, err := lockEph(p, lockMode)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	mounts, err := device.Mounts()
+	if err != nil {
+		return fmt.Errorf("failed to read mounts: %v", err)
+	}
+
+	f := &fsck{
+		p:       p,
+		repair:  repair,
+		mounted: make(map[string]device.Mount),
+	}
+
+	// Mounts stacked on top of each other are listed in order
+	for _, m := range mounts {
+		f.mounted[m.MountPoint] = m
+	}
+
+	if m, ok := f.mounted[layout.Staging(p)]; !ok || m.FsType != "tmpfs" {
+		return fmt.Errorf("ramdisk %s isn't mounted, use eph recover to put the original data back", layout.Staging(p))
+	}
+
+	if err = f.readSnapshotsState(); err != nil {
+		return err
+	}
+
+	if f.ss.Snapshots == nil {
+		f.ss.Snapshots = make(map[int]Snapshot)
+	}
+
+	if err = f.checkSnapshots(); err != nil {
+		return err
+	}
+
+	if err = f.checkSnapshotMounts(); err != nil {
+		return err
+	}
+
+	if err = f.checkOverlay(); err != nil {
+		return err
+	}
+
+	if f.ssChanged {
+		if err = f.ss.write(layout.SnapshotsState(p)); err != nil {
+			return fmt.Errorf("failed to update snapshots state: %v", err)
+		}
+	}
+
+	return f.print()
+}
+
+// readSnapshotsState reads the snapshots state, or its backup if it's corrupt
+func (f *fsck) readSnapshotsState() error {
+	var (
+		statePath = layout.SnapshotsState(f.p)
+		backup    = snapshotsStateBackup(statePath)
+		err       error
+	)
+
+	if f.ss, err = readSnapshotsStateFile(statePath); err == nil {
+		return nil
+	} else if !isCorruptJSON(err) {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	stateErr := err
+
+	if f.ss, err = readSnapshotsStateFile(backup); err != nil {
+		return fmt.Errorf("snapshots state %s is corrupt (%v), and its backup %s can't be read either: %v", statePath, stateErr, backup, err)
+	}
+
+	return f.report("snapshots-state-corrupt", fmt.Sprintf("restore it from %s", backup), func() error {
+		f.ssChanged = true
+		return nil
+	}, "snapshots state %s is corrupt: %v", statePath, stateErr)
+}
+
+// report records a problem. If it can be repaired, fix is run with --repair.
+func (f *fsck) report(code, repair string, fix func() error, format string, args ...interface{}) error {
+	problem := fsckProblem{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	if fix != nil {
+		problem.Repair = repair
+
+		if f.repair {
+			if err := fix(); err != nil {
+				return fmt.Errorf("failed to repair: %s: %v", problem.Message, err)
+			}
+
+			problem.Repaired = true
+		}
+	}
+
+	f.problems = append(f.problems, problem)
+	return nil
+}
+
+func (f *fsck) snapshotIds() []int {
+	ids := make([]int, 0, len(f.ss.Snapshots))
+	for id := range f.ss.Snapshots {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// checkSnapshots compares the snapshots in the state with the images
+// and checks that they form a tree
+func (f *fsck) checkSnapshots() error {
+	var (
+		ss    = f.ss
+		ids   = f.snapshotIds()
+		maxId int
+	)
+
+	for _, id := range ids {
+		snap := ss.Snapshots[id]
+
+		if snap.Id != id {
+			err := f.report("snapshot-id-mismatch", fmt.Sprintf("set its ID to %d", id), func() error {
+				snap.Id = id
+				ss.Snapshots[id] = snap
+				f.ssChanged = true
+				return nil
+			}, "snapshot %d is recorded with ID %d", id, snap.Id)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if id > maxId {
+			maxId = id
+		}
+	}
+
+	if ss.Counter < maxId {
+		err := f.report("snapshot-counter-behind", fmt.Sprintf("set it to %d", maxId), func() error {
+			ss.Counter = maxId
+			f.ssChanged = true
+			return nil
+		}, "snapshot counter %d is behind snapshot %d, which the next snapshot would overwrite", ss.Counter, maxId)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := f.checkSnapshotImages(ids); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if parent := ss.Snapshots[id].Parent; parent != 0 {
+			if _, ok := ss.Snapshots[parent]; !ok {
+				if err := f.report("snapshot-parent-missing", "", nil, "snapshot %d depends on snapshot %d, which doesn't exist", id, parent); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, cycle := range snapshotCycles(ss) {
+		if err := f.report("snapshot-cycle", "", nil, "snapshots %v depend on each other", cycle); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSnapshotImages looks for snapshot images missing from the state,
+// left behind by snapshot new when interrupted, and the other way round
+func (f *fsck) checkSnapshotImages(ids []int) error {
+	var (
+		ss           = f.ss
+		snapshotsDir = layout.Snapshots(f.p)
+	)
+
+	infos, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots directory: %v", err)
+	}
+
+	images := make(map[int]bool)
+
+	for _, info := range infos {
+		var id int
+		if _, err := fmt.Sscanf(info.Name(), "snap-%d.squash", &id); err != nil || info.Name() != layout.SnapshotFilename(id) {
+			continue
+		}
+
+		images[id] = true
+
+		if _, ok := ss.Snapshots[id]; ok {
+			continue
+		}
+
+		imagePath := path.Join(snapshotsDir, info.Name())
+
+		err := f.report("snapshot-image-orphaned", "remove it", func() error {
+			return os.Remove(imagePath)
+		}, "snapshot image %s isn't in the snapshots state", imagePath)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		if images[id] {
+			continue
+		}
+
+		var (
+			id        = id
+			imagePath = path.Join(snapshotsDir, layout.SnapshotFilename(id))
+			revDeps   = reverseSnapshotDependencies(id, ss)
+		)
+
+		switch {
+		case id == ss.AppliedSnapshot:
+			err = f.report("snapshot-image-missing", "", nil, "image %s of the applied snapshot %d is missing, apply another snapshot", imagePath, id)
+		case len(revDeps) > 0:
+			sort.Ints(revDeps)
+			err = f.report("snapshot-image-missing", "", nil, "image %s of snapshot %d is missing, snapshots %v depend on it", imagePath, id, revDeps)
+		default:
+			err = f.report("snapshot-image-missing", "remove the snapshot from the snapshots state", func() error {
+				delete(ss.Snapshots, id)
+				f.ssChanged = true
+				return nil
+			}, "image %s of snapshot %d is missing", imagePath, id)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotCycles finds the snapshots whose parents lead back to them
+func snapshotCycles(ss *SnapshotsState) [][]int {
+	var (
+		cycles [][]int
+		// Snapshots known to lead to the root, or into a cycle
+		done = make(map[int]bool)
+	)
+
+	for id := range ss.Snapshots {
+		var (
+			chain   []int
+			inChain = make(map[int]int)
+		)
+
+		for cur := id; cur != 0 && !done[cur]; cur = ss.Snapshots[cur].Parent {
+			if start, ok := inChain[cur]; ok {
+				cycle := append([]int{}, chain[start:]...)
+				sort.Ints(cycle)
+				cycles = append(cycles, cycle)
+				break
+			}
+
+			if _, ok := ss.Snapshots[cur]; !ok {
+				// Missing parent, reported on its own
+				break
+			}
+
+			inChain[cur] = len(chain)
+			chain = append(chain, cur)
+		}
+
+		for _, cur := range chain {
+			done[cur] = true
+		}
+	}
+
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i][0] < cycles[j][0] })
+
+	return cycles
+}
+
+// headLayers lists the lower layers HEAD is made of when snapId is applied,
+// the snapshot mounts followed by orig
+func (f *fsck) headLayers(snapId int) ([]string, error) {
+	snapLayers, err := listHeadLayersForSnapshot(snapId, f.ss)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]string, 0, len(snapLayers)+1)
+
+	for _, id := range snapLayers {
+		if _, ok := f.ss.Snapshots[id]; !ok {
+			return nil, fmt.Errorf("snapshot %d doesn't exist", id)
+		}
+
+		layers = append(layers, path.Join(layout.SnapshotMounts(f.p), layout.SnapshotMountpointTarget(id)))
+	}
+
+	return append(layers, layout.Orig(f.p)), nil
+}
+
+// headSnapshot finds out which snapshot HEAD shows by its layers.
+// false is returned if it doesn't match any of them.
+func (f *fsck) headSnapshot(head device.Mount) (int, bool) {
+	if head.FsType != "overlay" {
+		// A bind mount of orig
+		var headSt, origSt syscall.Stat_t
+
+		if syscall.Stat(head.MountPoint, &headSt) != nil || syscall.Stat(layout.Orig(f.p), &origSt) != nil {
+			return 0, false
+		}
+
+		return 0, headSt.Dev == origSt.Dev && headSt.Ino == origSt.Ino
+	}
+
+	// The applied snapshot is checked first
+	for _, id := range append([]int{f.ss.AppliedSnapshot}, f.snapshotIds()...) {
+		if id == 0 {
+			continue
+		}
+
+		layers, err := f.headLayers(id)
+		if err == nil && strings.Join(layers, ":") == head.Options["lowerdir"] {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+// checkSnapshotMounts checks that HEAD is made of the applied snapshot and
+// that no other snapshots are mounted
+func (f *fsck) checkSnapshotMounts() error {
+	var (
+		ss             = f.ss
+		head           = layout.Head(f.p)
+		snapshotMounts = layout.SnapshotMounts(f.p)
+		// Snapshot mounts HEAD is made of
+		inUse = make(map[string]bool)
+	)
+
+	headMount, headMounted := f.mounted[head]
+
+	if headMounted {
+		if headMount.FsType == "overlay" {
+			for _, layer := range strings.Split(headMount.Options["lowerdir"], ":") {
+				inUse[layer] = true
+			}
+		}
+	} else if layers, err := f.headLayers(ss.AppliedSnapshot); err == nil {
+		// Mounted again along with HEAD
+		for _, layer := range layers {
+			inUse[layer] = true
+		}
+	}
+
+	infos, err := ioutil.ReadDir(snapshotMounts)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot mounts directory: %v", err)
+	}
+
+	for _, info := range infos {
+		mountPoint := path.Join(snapshotMounts, info.Name())
+
+		if inUse[mountPoint] {
+			continue
+		}
+
+		if _, ok := f.mounted[mountPoint]; ok {
+			err = f.report("snapshot-mount-stale", "unmount it", func() error {
+				if err := device.UnmountSquash(mountPoint); err != nil {
+					return err
+				}
+				return os.Remove(mountPoint)
+			}, "snapshot %s is mounted, but HEAD doesn't use it", mountPoint)
+		} else {
+			err = f.report("snapshot-mount-stale", "remove it", func() error {
+				return os.Remove(mountPoint)
+			}, "stale snapshot mount point %s", mountPoint)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !headMounted {
+		if _, err := f.headLayers(ss.AppliedSnapshot); err != nil {
+			return f.report("head-unmounted", "", nil, "HEAD %s isn't mounted and the applied snapshot %d can't be mounted: %v", head, ss.AppliedSnapshot, err)
+		}
+
+		return f.report("head-unmounted", fmt.Sprintf("mount it with snapshot %d", ss.AppliedSnapshot), func() error {
+			return f.mountHead(ss.AppliedSnapshot)
+		}, "HEAD %s isn't mounted", head)
+	}
+
+	headSnap, ok := f.headSnapshot(headMount)
+
+	switch {
+	case !ok:
+		return f.report("head-mismatch", "", nil, "HEAD %s doesn't match any of the snapshots, apply a snapshot to reset the ramdisk", head)
+	case headSnap != ss.AppliedSnapshot:
+		// Left behind by snapshot apply when interrupted before
+		// recording the snapshot it has mounted
+		return f.report("head-mismatch", fmt.Sprintf("record snapshot %d as applied", headSnap), func() error {
+			ss.AppliedSnapshot = headSnap
+			f.ssChanged = true
+			return nil
+		}, "HEAD %s shows snapshot %d, but snapshot %d is recorded as applied", head, headSnap, ss.AppliedSnapshot)
+	}
+
+	return nil
+}
+
+// mountHead mounts HEAD along with the snapshots it's made of
+func (f *fsck) mountHead(snapId int) error {
+	layers, err := f.headLayers(snapId)
+	if err != nil {
+		return err
+	}
+
+	snapLayers, err := listHeadLayersForSnapshot(snapId, f.ss)
+	if err != nil {
+		return err
+	}
+
+	for i, id := range snapLayers {
+		mountPoint := layers[i]
+		if _, ok := f.mounted[mountPoint]; ok {
+			continue
+		}
+
+		if err = os.Mkdir(mountPoint, 0700); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create snapshot mount point %s: %v", mountPoint, err)
+		}
+
+		snapshotPath := path.Join(layout.Snapshots(f.p), layout.SnapshotFilename(id))
+		if err = device.MountSquash(snapshotPath, mountPoint); err != nil {
+			return fmt.Errorf("failed to mount snapshot %s: %v", snapshotPath, err)
+		}
+	}
+
+	if err = mountHead(layout.Head(f.p), layers); err != nil {
+		return err
+	}
+
+	f.mounted[layout.Head(f.p)] = device.Mount{MountPoint: layout.Head(f.p)}
+	return nil
+}
+
+// checkOverlay checks that the overlay at the target location
+// is mounted on top of HEAD and the upper layer in eph root
+func (f *fsck) checkOverlay() error {
+	journalPath := layout.MergeJournal(f.p)
+
+	if _, err := os.Lstat(journalPath); err == nil {
+		return f.report("merge-in-progress", "", nil, "a merge has been interrupted, use --resume or --abort to finish it")
+	}
+
+	m, ok := f.mounted[f.p]
+	if !ok {
+		if _, headMounted := f.mounted[layout.Head(f.p)]; !headMounted {
+			return f.report("overlay-unmounted", "", nil, "overlay %s isn't mounted", f.p)
+		}
+
+		return f.report("overlay-unmounted", "mount it", func() error {
+			return mountOverlay(f.p)
+		}, "overlay %s isn't mounted", f.p)
+	}
+
+	if m.FsType != "overlay" {
+		return f.report("overlay-mismatch", "", nil, "%s is mounted over %s instead of the overlay", m.FsType, f.p)
+	}
+
+	expected := []struct{ option, value string }{
+		{"lowerdir", layout.Head(f.p)},
+		{"upperdir", layout.OverlayDiff(f.p)},
+		{"workdir", layout.OverlayWorkdir(f.p)},
+	}
+
+	for _, opt := range expected {
+		if value := m.Options[opt.option]; value != opt.value {
+			if err := f.report("overlay-mismatch", "", nil, "overlay %s is mounted with %s=%s instead of %s", f.p, opt.option, value, opt.value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *fsck) print() error {
+	var left int
+	for _, problem := range f.problems {
+		if !problem.Repaired {
+			left++
+		}
+	}
+
+	switch output.Format {
+	case output.JSON:
+		problems := f.problems
+		if problems == nil {
+			problems = []fsckProblem{}
+		}
+
+		if err := output.WriteJSON(problems); err != nil {
+			return err
+		}
+	case output.Porcelain:
+		w := output.NewWriter()
+
+		for _, problem := range f.problems {
+			state := "manual"
+			if problem.Repaired {
+				state = "repaired"
+			} else if problem.Repair != "" {
+				state = "repairable"
+			}
+
+			w.Record(problem.Code, state, output.Quote(problem.Message))
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	default:
+		for _, problem := range f.problems {
+			switch {
+			case problem.Repaired:
+				fmt.Printf("%s: %s (repaired: %s)\n", problem.Code, problem.Message, problem.Repair)
+			case problem.Repair != "":
+				fmt.Printf("%s: %s (--repair will %s)\n", problem.Code, problem.Message, problem.Repair)
+			default:
+				fmt.Printf("%s: %s\n", problem.Code, problem.Message)
+			}
+		}
+
+		if len(f.problems) == 0 {
+			fmt.Println("no problems found")
+		}
+	}
+
+	if left > 0 {
+		return fmt.Errorf("%d of %d problems left", left, len(f.problems))
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package eph
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/ignore"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+const (
+	ephignoreFile = "/.ephignore"
+	gitignoreFile = "/.gitignore"
+)
+
+// loadIgnore reads the ignore rules of the overlay made of layers on top
+// of orig: .ephignore in its root, or .gitignore with --gitignore if there's
+// no .ephignore, followed by the patterns given with --ignore. nil is
+// returned if there are none.
+func loadIgnore(layers []string, orig string) (*ignore.Matcher, error) {
+	w := newChangeWalker(layers, orig, false, nil)
+
+	patterns, err := readIgnoreFile(w, ephignoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if patterns == nil && ignore.Gitignore {
+		if patterns, err = readIgnoreFile(w, gitignoreFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return ignore.New(append(patterns, ignore.Patterns...))
+}
+
+// readIgnoreFile reads the patterns in relPath as seen in the overlay.
+// nil is returned if there's no such file.
+func readIgnoreFile(w *changeWalker, relPath string) ([]string, error) {
+	c, err := w.lookupPath(relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.info == nil || !c.info.Mode().IsRegular() {
+		// Missing, deleted, or not a file
+		return nil, nil
+	}
+
+	f, err := os.Open(c.source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns, err := ignore.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", relPath[1:], err)
+	}
+
+	if patterns == nil {
+		patterns = []string{}
+	}
+
+	return patterns, nil
+}
+
+// isIgnored reports whether the change c is ignored by m. Deleted
+// directories are matched as directories, even though they're
+// whiteouts in the ramdisk.
+func isIgnored(m *ignore.Matcher, c *change) bool {
+	if m == nil {
+		return false
+	}
+
+	isDir := c.info.IsDir()
+	if c.status == statusDeleted {
+		isDir = c.origInfo.IsDir()
+	}
+
+	return m.Match(c.relPath[1:], isDir)
+}
+
+// writeSnapshotExcludes lists the ignored dirents of the upper layer diff
+// in a temporary file passed to mksquashfs with -ef. Paths are absolute,
+// mksquashfs finds them by their inodes. An empty string is returned
+// if there's nothing to exclude.
+func writeSnapshotExcludes(diff string, m *ignore.Matcher) (string, error) {
+	if m == nil {
+		return "", nil
+	}
+
+	var excluded []string
+	if err := findIgnored(diff, "", m, &excluded); err != nil {
+		return "", err
+	}
+
+	if len(excluded) == 0 {
+		return "", nil
+	}
+
+	f, err := ioutil.TempFile("", "eph-exclude")
+	if err != nil {
+		return "", err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, p := range excluded {
+		w.WriteString(p + "\n")
+	}
+
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func findIgnored(diff, relPath string, m *ignore.Matcher, excluded *[]string) error {
+	iter, err := diriter.NewIter(diff + relPath)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for ; !iter.AtEnd(); iter.Increment() {
+		var (
+			info      = iter.FileInfo()
+			childPath = relPath + "/" + info.Name()
+		)
+
+		switch {
+		case m.Match(childPath[1:], info.IsDir()):
+			*excluded = append(*excluded, diff+childPath)
+		case info.IsDir():
+			if err = findIgnored(diff, childPath, m, excluded); err != nil {
+				return err
+			}
+		}
+	}
+
+	return iter.Err()
+}
+
+// removeUnignored empties the upper layer diff except for the ignored
+// dirents, which stay in the ramdisk. Directories leading to them are kept
+// as plain directories, they no longer hide or redirect to anything in
+// the layers below.
+func removeUnignored(diff string, m *ignore.Matcher) error {
+	_, err := keepIgnored(diff, "", m)
+	return err
+}
+
+func keepIgnored(diff, relPath string, m *ignore.Matcher) (kept bool, err error) {
+	names, err := readOrigDirNames(diff + relPath)
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		var (
+			childPath = relPath + "/" + name
+			p         = diff + childPath
+		)
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			return false, err
+		}
+
+		if m.Match(childPath[1:], info.IsDir()) {
+			kept = true
+			continue
+		}
+
+		if info.IsDir() {
+			childKept, err := keepIgnored(diff, childPath, m)
+			if err != nil {
+				return false, err
+			}
+
+			if childKept {
+				if err = device.RemoveOpaqueAttr(p); err != nil && err != syscall.ENODATA {
+					return false, err
+				}
+
+				if err = device.RemoveRedirectAttr(p); err != nil && err != syscall.ENODATA {
+					return false, err
+				}
+
+				kept = true
+				continue
+			}
+		}
+
+		if err = os.RemoveAll(p); err != nil {
+			return false, err
+		}
+	}
+
+	return kept, nil
+}
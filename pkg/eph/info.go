@@ -0,0 +1,168 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"github.com/gman0/eph/pkg/output"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strconv"
+)
+
+// ramdiskInfo describes where the parts of a ramdisk are
+type ramdiskInfo struct {
+	Path    string `json:"path"`
+	EphRoot string `json:"eph_root"`
+	// Orig holds the original data. For --target ramdisks it's
+	// a symlink to Source, the directory the ramdisk overlays.
+	Orig   string      `json:"orig"`
+	Source string      `json:"source,omitempty"`
+	Mounts []mountInfo `json:"mounts"`
+	Quota  quotaInfo   `json:"quota"`
+}
+
+type mountInfo struct {
+	Path string `json:"path"`
+	// Type is one of tmpfs, bind, overlay or squashfs
+	Type string `json:"type"`
+}
+
+// quotaInfo is the capacity of the ramdisk and its usage, in bytes
+type quotaInfo struct {
+	Size      uint64 `json:"size"`
+	Used      uint64 `json:"used"`
+	Available uint64 `json:"available"`
+}
+
+// PrintRamdiskInfo prints the eph root, mount points and quota of ramdisk p.
+// There's nothing to print in text output.
+func PrintRamdiskInfo(p string) error {
+	if output.Format == output.Text {
+		return nil
+	}
+
+	if err := checkTargetAndBaseDirs(p, layout.Base(p)); err != nil {
+		return err
+	}
+
+	l, err := lockEph(p, lock.Shared)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	snapLayers, err := listHeadLayersForSnapshot(ss.AppliedSnapshot, ss)
+	if err != nil {
+		return err
+	}
+
+	quota, err := readQuota(layout.Staging(p))
+	if err != nil {
+		return err
+	}
+
+	info := ramdiskInfo{
+		Path:    p,
+		EphRoot: layout.Base(p),
+		Orig:    layout.Orig(p),
+		Mounts:  []mountInfo{{layout.Staging(p), "tmpfs"}},
+		Quota:   quota,
+	}
+
+	if target, err := os.Readlink(info.Orig); err == nil {
+		info.Source = target
+	}
+
+	for _, id := range snapLayers {
+		info.Mounts = append(info.Mounts, mountInfo{path.Join(layout.SnapshotMounts(p), layout.SnapshotMountpointTarget(id)), "squashfs"})
+	}
+
+	if len(snapLayers) > 0 {
+		info.Mounts = append(info.Mounts, mountInfo{layout.Head(p), "overlay"})
+	} else {
+		info.Mounts = append(info.Mounts, mountInfo{layout.Head(p), "bind"})
+	}
+
+	info.Mounts = append(info.Mounts, mountInfo{p, "overlay"})
+
+	if output.Format == output.JSON {
+		return output.WriteJSON(info)
+	}
+
+	w := output.NewWriter()
+
+	w.Record("path", output.Quote(info.Path))
+	w.Record("eph-root", output.Quote(info.EphRoot))
+	w.Record("orig", output.Quote(info.Orig))
+	if info.Source != "" {
+		w.Record("source", output.Quote(info.Source))
+	}
+	for _, m := range info.Mounts {
+		w.Record("mount", m.Type, output.Quote(m.Path))
+	}
+	writeQuotaRecord(w, quota)
+
+	return w.Flush()
+}
+
+// PrintQuota prints the capacity and usage of ramdisk p.
+// There's nothing to print in text output.
+func PrintQuota(p string) error {
+	if output.Format == output.Text {
+		return nil
+	}
+
+	if err := checkTargetAndBaseDirs(p, layout.Base(p)); err != nil {
+		return err
+	}
+
+	l, err := lockEph(p, lock.Shared)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	quota, err := readQuota(layout.Staging(p))
+	if err != nil {
+		return err
+	}
+
+	if output.Format == output.JSON {
+		return output.WriteJSON(quota)
+	}
+
+	w := output.NewWriter()
+	writeQuotaRecord(w, quota)
+
+	return w.Flush()
+}
+
+// readQuota reports the capacity and usage of the ramdisk mounted at staging
+func readQuota(staging string) (quotaInfo, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(staging, &st); err != nil {
+		return quotaInfo{}, fmt.Errorf("failed to stat ramdisk: %v", err)
+	}
+
+	bsize := uint64(st.Bsize)
+
+	return quotaInfo{
+		Size:      st.Blocks * bsize,
+		Used:      (st.Blocks - st.Bfree) * bsize,
+		Available: st.Bavail * bsize,
+	}, nil
+}
+
+func writeQuotaRecord(w *output.Writer, quota quotaInfo) {
+	w.Record("quota",
+		strconv.FormatUint(quota.Size, 10),
+		strconv.FormatUint(quota.Used, 10),
+		strconv.FormatUint(quota.Available, 10))
+}
@@ -0,0 +1,54 @@
+package eph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is returned by a merge stopped by SIGINT or SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// interruptHandler catches SIGINT and SIGTERM so that a merge can stop
+// at a point from which it can be resumed, instead of dying in the middle
+// of writing a file. Another signal received after the first one
+// terminates the process as usual.
+type interruptHandler struct {
+	sigs chan os.Signal
+	stop chan struct{}
+}
+
+func handleInterrupts() *interruptHandler {
+	h := &interruptHandler{
+		sigs: make(chan os.Signal, 1),
+		stop: make(chan struct{}),
+	}
+
+	signal.Notify(h.sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		if sig, ok := <-h.sigs; ok {
+			signal.Stop(h.sigs)
+			fmt.Fprintf(os.Stderr, "\n%v received, stopping once the files being written are finished\n", sig)
+			close(h.stop)
+		}
+	}()
+
+	return h
+}
+
+func (h *interruptHandler) interrupted() bool {
+	select {
+	case <-h.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *interruptHandler) release() {
+	signal.Stop(h.sigs)
+	close(h.sigs)
+}
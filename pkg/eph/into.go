@@ -0,0 +1,140 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/layout"
+	"os"
+	"path"
+	"strings"
+)
+
+// checkMergeInto makes sure the changes of ramdisk p can be written into dir
+func checkMergeInto(p, dir string) error {
+	if !path.IsAbs(dir) {
+		return fmt.Errorf("destination %s must be an absolute path", dir)
+	}
+
+	if isNotExist, err := layout.DirectoryShouldExist(dir); err != nil {
+		if isNotExist {
+			return fmt.Errorf("destination %s does not exist", dir)
+		}
+		return err
+	}
+
+	for _, p := range []string{p, layout.Base(p)} {
+		if dir == p || strings.HasPrefix(dir, p+"/") {
+			return fmt.Errorf("destination %s is inside %s", dir, p)
+		}
+	}
+
+	return nil
+}
+
+// retargetOps adjusts the ops planned against orig to the contents
+// of another directory: targets missing in dir are added instead of
+// replaced, existing ones are replaced instead of added, and deletions
+// of targets that don't exist are skipped. Renamed files whose original
+// versions are missing in dir are copied instead.
+func retargetOps(ops []mergeOp, dir string) ([]mergeOp, error) {
+	var (
+		retargeted  = make([]mergeOp, 0, len(ops))
+		renamedDirs = renamedDirOps(ops)
+		// Shallow directories added by the merge, renames
+		// may move dirents into them
+		shallow = make(map[string]bool)
+	)
+
+	for _, op := range ops {
+		// Contents of renamed directories are at the original paths until they're merged
+		target := dir + origLocation(ops, renamedDirs, op.Path)
+
+		if op.Shallow {
+			shallow[op.Path] = true
+		}
+
+		if !op.Nested && !shallow[path.Dir(op.Path)] {
+			// Nested ops are staged inside their parents
+			if _, err := os.Stat(path.Dir(target)); err != nil {
+				return nil, fmt.Errorf("can't merge %s into %s: %v", op.Path[1:], dir, err)
+			}
+		}
+
+		info, err := os.Lstat(target)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		exists := err == nil
+
+		switch op.Kind {
+		case mergeAdd:
+			if exists {
+				op.Kind = mergeReplace
+			}
+		case mergeReplace:
+			if !exists {
+				op.Kind = mergeAdd
+				op.Meta = false
+			}
+		case mergeDelete:
+			if !exists {
+				continue
+			}
+
+			op.Dir = info.IsDir()
+			if op.Files, op.Bytes, _, err = treeStat(target); err != nil {
+				return nil, err
+			}
+		case mergeAttr:
+			if !exists || !info.IsDir() {
+				return nil, fmt.Errorf("can't merge %s into %s: not a directory", op.Path[1:], dir)
+			}
+
+			setOrigAttrs(&op, info)
+		case mergeRename:
+			from := dir + origLocation(ops, renamedDirs, op.From)
+
+			fromInfo, err := os.Lstat(from)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+
+			if fromInfo != nil && !exists {
+				setOrigAttrs(&op, fromInfo)
+				break
+			}
+
+			if op.Dir {
+				return nil, fmt.Errorf("can't merge %s renamed from %s into %s: %s is missing or %s is in the way",
+					op.Path[1:], op.From[1:], dir, op.From[1:], op.Path[1:])
+			}
+
+			// Copied like any other file, the original version is deleted
+			// if there's one
+			oldPath := op.From
+
+			op.Kind = mergeAdd
+			if exists {
+				op.Kind = mergeReplace
+			}
+
+			op.From = ""
+			if op.Files, op.Bytes, op.Changed, err = treeStat(op.Source); err != nil {
+				return nil, err
+			}
+
+			if fromInfo != nil {
+				retargeted = append(retargeted, op)
+
+				op = mergeOp{Kind: mergeDelete, Path: oldPath}
+				if op.Files, op.Bytes, _, err = treeStat(from); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		retargeted = append(retargeted, op)
+	}
+
+	return retargeted, nil
+}
@@ -0,0 +1,815 @@
+package eph
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gman0/eph/pkg/beneath"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/fscopy"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/progress"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Directories opened by a merge are closed once there's more of them
+const maxOpenDirs = 64
+
+type mergeOpKind string
+
+const (
+	mergeAdd     mergeOpKind = "add"
+	mergeReplace mergeOpKind = "replace"
+	mergeDelete  mergeOpKind = "delete"
+	mergeAttr    mergeOpKind = "attr"
+	mergeRename  mergeOpKind = "rename"
+)
+
+// mergeOp is a single change to be written into the merge destination.
+//
+// New versions of dirents are first copied next to their targets,
+// and only once all of them are in place, they are renamed over
+// the targets. Previous versions are kept aside until the very end
+// so that the merge can be reverted.
+type mergeOp struct {
+	Kind mergeOpKind `json:"kind"`
+	// Path is relative to the merge destination
+	Path string `json:"path"`
+	// Source is the absolute path of the new version in one of the ramdisk layers
+	Source string `json:"source,omitempty"`
+	// From is the path a mergeRename op moves to Path, relative to
+	// the merge destination. Contents of renamed directories stay
+	// at From until the op is committed, see locate.
+	From string `json:"from,omitempty"`
+	Dir  bool   `json:"dir,omitempty"`
+	// Shallow directories are merged without their contents,
+	// which are then merged by separate ops in a partial merge
+	Shallow bool `json:"shallow,omitempty"`
+	// Nested ops are merged into the staged copy of a shallow parent
+	// and are committed along with it
+	Nested bool `json:"nested,omitempty"`
+	// Meta is set for replaced files whose contents are the same,
+	// only their metadata has changed
+	Meta bool `json:"meta,omitempty"`
+
+	// Files is the number of dirents the op copies, or deletes
+	Files int64 `json:"files,omitempty"`
+	// Bytes is the apparent size of the data the op copies, or deletes
+	Bytes int64 `json:"bytes,omitempty"`
+	// Changed is the most recent change time found in Source, in nanoseconds
+	Changed int64 `json:"changed,omitempty"`
+
+	// Original attributes of Path, used to revert mergeAttr and mergeRename ops
+	Mode os.FileMode `json:"mode,omitempty"`
+	Uid  int         `json:"uid,omitempty"`
+	Gid  int         `json:"gid,omitempty"`
+
+	// SourceAttrs are the attributes of Source set on Path when committing,
+	// see needsSourceAttrs
+	SourceAttrs *direntAttrs `json:"source_attrs,omitempty"`
+}
+
+// direntAttrs are the attributes copied by copyAttrs
+type direntAttrs struct {
+	Mode os.FileMode `json:"mode"`
+	Uid  int         `json:"uid"`
+	Gid  int         `json:"gid"`
+	// Atime and Mtime are in nanoseconds
+	Atime  int64             `json:"atime"`
+	Mtime  int64             `json:"mtime"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// needsSourceAttrs reports whether the op sets the attributes of Source
+// when committing, rather than copying them along with the contents while
+// staging. They're recorded while staging, since once the merge is past it,
+// it may be finished after a reboot without the ramdisk holding Source.
+func (op *mergeOp) needsSourceAttrs() bool {
+	if op.Source == "" {
+		return false
+	}
+
+	return op.Shallow || op.Kind == mergeAttr || op.Kind == mergeRename
+}
+
+type mergePhase string
+
+const (
+	// New versions are being copied next to their targets, the destination is unchanged
+	mergePhaseStaging mergePhase = "staging"
+	// New versions are being renamed over their targets
+	mergePhaseCommit mergePhase = "commit"
+	// All new versions are in place, previous versions are being removed
+	mergePhaseCleanup mergePhase = "cleanup"
+)
+
+// mergeJournal is stored in eph root for the whole duration of a merge.
+// Each of the operations is idempotent and its progress can be deduced
+// from the destination itself, so it's enough to record only the phase.
+type mergeJournal struct {
+	Phase mergePhase `json:"phase"`
+	// Done is the number of ops finished in the current phase,
+	// recorded when the merge is interrupted
+	Done int       `json:"done,omitempty"`
+	Dest string    `json:"dest"`
+	Ops  []mergeOp `json:"ops"`
+	// Backup is the path prefix of the backup of all dirents
+	// modified by the merge. Empty if no backup is made.
+	Backup string `json:"backup,omitempty"`
+	// BackupDest is where Dest ends up once the merge is done
+	BackupDest string `json:"backup_dest,omitempty"`
+	// Mode determines what happens with the ramdisk after the merge
+	Mode mergeMode `json:"mode,omitempty"`
+
+	// Indices of ops by path, used to find the parents of nested ops
+	opsByPath map[string]int
+	// Indices of ops renaming directories, see locate
+	renamedDirs    []int
+	renamesIndexed bool
+
+	// Dest is accessed only through directories opened beneath it, see resolve
+	root *beneath.Root
+	dirs map[string]*os.File
+
+	intr     *interruptHandler
+	progress *progress.Reporter
+	// links keeps hardlinks together across the ops staged by a run.
+	// Links to dirents staged before the merge has been resumed
+	// are copied on their own.
+	links *fscopy.Links
+}
+
+func (j *mergeJournal) write(p string) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b, 0600)
+}
+
+func readMergeJournal(p string) (*mergeJournal, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &mergeJournal{}
+
+	return j, json.Unmarshal(b, j)
+}
+
+// opPaths are the paths an op works with, resolved beneath Dest
+type opPaths struct {
+	target string
+	staged string
+	old    string
+}
+
+func (j *mergeJournal) paths(opIdx int) (*opPaths, error) {
+	var (
+		ps  opPaths
+		err error
+	)
+
+	if j.Ops[opIdx].Nested {
+		return j.nestedPaths(opIdx)
+	}
+
+	if ps.target, err = j.resolve(j.Ops[opIdx].Path); err != nil {
+		return nil, err
+	}
+
+	if ps.staged, err = j.resolve(j.stagedRel(opIdx)); err != nil {
+		return nil, err
+	}
+
+	if ps.old, err = j.resolve(path.Join(path.Dir(j.Ops[opIdx].Path), layout.MergeOldName(opIdx))); err != nil {
+		return nil, err
+	}
+
+	return &ps, nil
+}
+
+// nestedPaths are the paths of a nested op. Either of them is empty
+// if it doesn't exist: the target's parent may be added by the merge,
+// and the staged parent is gone once it's been committed.
+// Nested ops are never moved aside on their own.
+func (j *mergeJournal) nestedPaths(opIdx int) (*opPaths, error) {
+	var (
+		ps  opPaths
+		err error
+	)
+
+	if ps.target, err = j.resolve(j.Ops[opIdx].Path); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		ps.target = ""
+	}
+
+	if ps.staged, err = j.resolve(j.stagedRel(opIdx)); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		ps.staged = ""
+	}
+
+	return &ps, nil
+}
+
+func (j *mergeJournal) stagedRel(opIdx int) string {
+	if j.Ops[opIdx].Nested {
+		return path.Join(j.stagedRel(j.parent(opIdx)), path.Base(j.Ops[opIdx].Path))
+	}
+
+	return path.Join(path.Dir(j.Ops[opIdx].Path), layout.MergeStagedName(opIdx))
+}
+
+// resolve returns a path to relPath within Dest whose parent directory
+// has been opened beneath Dest without following any symlinks. Should
+// any of the parents be replaced by a symlink, the merge can't be
+// redirected outside of Dest.
+func (j *mergeJournal) resolve(relPath string) (string, error) {
+	relPath, err := j.locate(relPath)
+	if err != nil {
+		return "", err
+	}
+
+	if j.root == nil {
+		root, err := beneath.Open(j.Dest)
+		if err != nil {
+			return "", err
+		}
+
+		j.root = root
+		j.dirs = make(map[string]*os.File)
+	}
+
+	dir := path.Dir(relPath)
+
+	f, ok := j.dirs[dir]
+	if !ok {
+		var err error
+		if f, err = j.root.OpenDir(dir); err != nil {
+			return "", err
+		}
+
+		j.dirs[dir] = f
+	}
+
+	return path.Join(beneath.FdPath(f), path.Base(relPath)), nil
+}
+
+// locate finds where relPath is in Dest at the moment. Until a renamed
+// directory is committed, its contents are still at the original path.
+func (j *mergeJournal) locate(relPath string) (string, error) {
+	if !j.renamesIndexed {
+		j.renamedDirs = renamedDirOps(j.Ops)
+		j.renamesIndexed = true
+	}
+
+	for {
+		i := renamedAncestor(j.Ops, j.renamedDirs, relPath)
+		if i < 0 {
+			return relPath, nil
+		}
+
+		target, err := j.resolve(j.Ops[i].Path)
+		if err == nil {
+			isRenamed, err := lexists(target)
+			if err != nil || isRenamed {
+				return relPath, err
+			}
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		relPath = j.Ops[i].From + relPath[len(j.Ops[i].Path):]
+	}
+}
+
+// closeDirs closes the directories opened by resolve
+func (j *mergeJournal) closeDirs() {
+	for _, f := range j.dirs {
+		f.Close()
+	}
+
+	j.dirs = make(map[string]*os.File)
+}
+
+func (j *mergeJournal) close() {
+	if j.root != nil {
+		j.closeDirs()
+		j.root.Close()
+		j.root = nil
+	}
+}
+
+func (j *mergeJournal) parent(opIdx int) int {
+	if j.opsByPath == nil {
+		j.opsByPath = make(map[string]int, len(j.Ops))
+		for i := range j.Ops {
+			j.opsByPath[j.Ops[i].Path] = i
+		}
+	}
+
+	return j.opsByPath[path.Dir(j.Ops[opIdx].Path)]
+}
+
+// run executes the remaining phases of the merge up until the phase
+// specified in `until`. Passing an empty phase runs all of them.
+//
+// SIGINT and SIGTERM stop the merge once the op in progress is finished,
+// or once the files being copied are, and errInterrupted is returned.
+// The journal is left in place so that the merge can be resumed.
+func (j *mergeJournal) run(journalPath string, until mergePhase) error {
+	defer j.close()
+
+	j.intr = handleInterrupts()
+	defer j.intr.release()
+
+	interrupt := func() error {
+		if err := j.write(journalPath); err != nil {
+			return fmt.Errorf("failed to update merge journal: %v", err)
+		}
+		return errInterrupted
+	}
+
+	type phase struct {
+		name    mergePhase
+		next    mergePhase
+		f       func(opIdx int) error
+		finish  func() error
+		reverse bool
+	}
+
+	finishStaging := func() error {
+		if j.Backup != "" {
+			return j.finishBackup()
+		}
+		return nil
+	}
+
+	phases := []phase{
+		{mergePhaseStaging, mergePhaseCommit, j.stage, finishStaging, false},
+		{mergePhaseCommit, mergePhaseCleanup, j.commit, nil, false},
+		// Children are cleaned up before their parents
+		{mergePhaseCleanup, "", j.cleanup, nil, true},
+	}
+
+	for _, ph := range phases {
+		if j.Phase != ph.name {
+			continue
+		}
+
+		if j.Phase == until {
+			break
+		}
+
+		if ph.name == mergePhaseStaging {
+			j.startProgress()
+
+			j.links = fscopy.NewLinks()
+			defer j.links.Close()
+		}
+
+		for ; j.Done < len(j.Ops); j.Done++ {
+			if j.intr.interrupted() {
+				j.stopProgress()
+				return interrupt()
+			}
+
+			i := j.Done
+			if ph.reverse {
+				i = len(j.Ops) - j.Done - 1
+			}
+
+			if err := ph.f(i); err != nil {
+				j.stopProgress()
+
+				if err == fscopy.ErrInterrupted {
+					// The op is repeated once resumed
+					return interrupt()
+				}
+				return fmt.Errorf("%s %s: %v", j.Ops[i].Kind, j.Ops[i].Path, err)
+			}
+
+			if len(j.dirs) > maxOpenDirs {
+				j.closeDirs()
+			}
+		}
+
+		j.stopProgress()
+
+		// Directories are renamed and removed by the phase,
+		// open them anew in the next one
+		j.closeDirs()
+
+		if j.intr.interrupted() {
+			return interrupt()
+		}
+
+		if ph.finish != nil {
+			if err := ph.finish(); err != nil {
+				if j.intr.interrupted() {
+					// The signal was delivered to child processes as well
+					return interrupt()
+				}
+				return err
+			}
+		}
+
+		if ph.next == "" {
+			break
+		}
+
+		if err := device.SyncFs(j.Dest); err != nil {
+			return fmt.Errorf("failed to sync %s: %v", j.Dest, err)
+		}
+
+		j.Phase = ph.next
+		j.Done = 0
+		if err := j.write(journalPath); err != nil {
+			return fmt.Errorf("failed to update merge journal: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// startProgress reports the progress of copying the remaining ops
+func (j *mergeJournal) startProgress() {
+	var files, bytes int64
+
+	for i := j.Done; i < len(j.Ops); i++ {
+		if j.Ops[i].Kind == mergeAdd || j.Ops[i].Kind == mergeReplace {
+			files += j.Ops[i].Files
+			bytes += j.Ops[i].Bytes
+		}
+	}
+
+	j.progress = progress.New("copying", files, bytes)
+}
+
+func (j *mergeJournal) stopProgress() {
+	if j.progress != nil {
+		j.progress.Stop()
+		j.progress = nil
+	}
+}
+
+// copier copies the new versions of dirents, as well as backups of the previous ones
+func (j *mergeJournal) copier(withProgress bool) *fscopy.Copier {
+	c := &fscopy.Copier{}
+
+	if j.intr != nil {
+		c.Stop = j.intr.stop
+	}
+
+	if withProgress && j.progress != nil {
+		c.Progress = j.progress.Add
+	}
+
+	return c
+}
+
+func (j *mergeJournal) stage(opIdx int) error {
+	op := &j.Ops[opIdx]
+
+	if j.Backup != "" {
+		if err := j.backup(opIdx); err != nil {
+			return err
+		}
+	}
+
+	if op.needsSourceAttrs() {
+		attrs, err := readAttrs(op.Source)
+		if err != nil {
+			return err
+		}
+
+		op.SourceAttrs = attrs
+	}
+
+	if op.Kind != mergeAdd && op.Kind != mergeReplace {
+		return nil
+	}
+
+	ps, err := j.paths(opIdx)
+	if err != nil {
+		return err
+	}
+
+	// A copy left behind by an interrupted merge may be incomplete
+	if err = os.RemoveAll(ps.staged); err != nil {
+		return err
+	}
+
+	if op.Shallow {
+		// Attributes are set when committing, once the contents are staged
+		if err = os.Mkdir(ps.staged, 0700); err == nil && j.progress != nil {
+			j.progress.Add(1, 0)
+		}
+		return err
+	}
+
+	c := j.copier(true)
+	c.Links = j.links
+
+	if err = c.Tree(op.Source, ps.staged); err != nil {
+		if err == fscopy.ErrInterrupted {
+			return err
+		}
+		return fmt.Errorf("failed to copy %s: %v", op.Source, err)
+	}
+
+	return nil
+}
+
+func (j *mergeJournal) commit(opIdx int) error {
+	op := &j.Ops[opIdx]
+
+	if op.Nested && !op.Shallow {
+		return nil
+	}
+
+	ps, err := j.paths(opIdx)
+	if err != nil {
+		return err
+	}
+
+	if op.Nested {
+		// The parent may have been committed already
+		isStaged, err := lexists(ps.staged)
+		if err != nil {
+			return err
+		}
+
+		if isStaged {
+			return setAttrs(op.SourceAttrs, ps.staged)
+		}
+		return setAttrs(op.SourceAttrs, ps.target)
+	}
+
+	switch op.Kind {
+	case mergeAdd, mergeReplace:
+		isStaged, err := lexists(ps.staged)
+		if err != nil || !isStaged {
+			// The staged copy is gone only once it's been renamed over the target
+			return err
+		}
+
+		if op.Kind == mergeReplace {
+			if err = moveAside(ps.target, ps.old); err != nil {
+				return err
+			}
+		}
+
+		if op.Shallow {
+			if err = setAttrs(op.SourceAttrs, ps.staged); err != nil {
+				return err
+			}
+		}
+
+		return os.Rename(ps.staged, ps.target)
+	case mergeDelete:
+		return moveAside(ps.target, ps.old)
+	case mergeAttr:
+		return setAttrs(op.SourceAttrs, ps.target)
+	case mergeRename:
+		isRenamed, err := lexists(ps.target)
+		if err != nil {
+			return err
+		}
+
+		if !isRenamed {
+			from, err := j.resolve(op.From)
+			if err != nil {
+				return err
+			}
+
+			if err = os.Rename(from, ps.target); err != nil {
+				return err
+			}
+
+			// Directories opened beneath the renamed one have moved
+			j.closeDirs()
+
+			if ps.target, err = j.resolve(op.Path); err != nil {
+				return err
+			}
+		}
+
+		if op.Source == "" {
+			// Reverted by an undo
+			return restoreAttrs(op, ps.target)
+		}
+		return setAttrs(op.SourceAttrs, ps.target)
+	}
+
+	return nil
+}
+
+func (j *mergeJournal) cleanup(opIdx int) error {
+	if j.Ops[opIdx].Nested {
+		return nil
+	}
+
+	if j.Ops[opIdx].Kind == mergeAttr || j.Ops[opIdx].Kind == mergeRename {
+		// Removing previous versions of the children has changed
+		// the directory's timestamps, set them once more
+		return j.commit(opIdx)
+	}
+
+	ps, err := j.paths(opIdx)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(ps.old)
+}
+
+// abort reverts the operations in reverse order
+func (j *mergeJournal) abort() error {
+	defer j.close()
+
+	for i := len(j.Ops) - 1; i >= 0; i-- {
+		if err := j.abortOp(i); err != nil {
+			return fmt.Errorf("%s %s: %v", j.Ops[i].Kind, j.Ops[i].Path, err)
+		}
+
+		// Reverting an op may rename its parents
+		j.closeDirs()
+	}
+
+	if j.Backup != "" {
+		if err := j.discardBackup(); err != nil {
+			return fmt.Errorf("failed to discard backup: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (j *mergeJournal) abortOp(opIdx int) error {
+	op := &j.Ops[opIdx]
+
+	if op.Nested && j.Phase != mergePhaseStaging {
+		// Reverted along with the parent
+		return nil
+	}
+
+	ps, err := j.paths(opIdx)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Nothing has been written into the op's parent
+			return nil
+		}
+		return err
+	}
+
+	var (
+		target = ps.target
+		staged = ps.staged
+		old    = ps.old
+	)
+
+	if j.Phase == mergePhaseStaging {
+		if staged == "" {
+			return nil
+		}
+		return os.RemoveAll(staged)
+	}
+
+	isStaged, err := lexists(staged)
+	if err != nil {
+		return err
+	}
+
+	hasOld, err := lexists(old)
+	if err != nil {
+		return err
+	}
+
+	switch op.Kind {
+	case mergeAdd:
+		if !isStaged {
+			return os.RemoveAll(target)
+		}
+	case mergeReplace:
+		if hasOld {
+			if !isStaged {
+				if err = os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+
+			if err = os.Rename(old, target); err != nil {
+				return err
+			}
+		}
+	case mergeDelete:
+		if hasOld {
+			return os.Rename(old, target)
+		}
+	case mergeAttr:
+		return restoreAttrs(op, target)
+	case mergeRename:
+		isRenamed, err := lexists(target)
+		if err != nil || !isRenamed {
+			return err
+		}
+
+		if err = restoreAttrs(op, target); err != nil {
+			return err
+		}
+
+		from, err := j.resolve(op.From)
+		if err != nil {
+			return err
+		}
+
+		return os.Rename(target, from)
+	}
+
+	return os.RemoveAll(staged)
+}
+
+// restoreAttrs sets the ownership and permissions of target
+// recorded in the op to revert it
+func restoreAttrs(op *mergeOp, target string) error {
+	if err := os.Lchown(target, op.Uid, op.Gid); err != nil {
+		return err
+	}
+
+	return beneath.Chmod(target, op.Mode)
+}
+
+// readAttrs reads the ownership, permissions, extended attributes
+// and timestamps of p
+func readAttrs(p string) (*direntAttrs, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs, err := fscopy.Xattrs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	st := info.Sys().(*syscall.Stat_t)
+
+	return &direntAttrs{
+		Mode:   info.Mode(),
+		Uid:    int(st.Uid),
+		Gid:    int(st.Gid),
+		Atime:  st.Atim.Nano(),
+		Mtime:  st.Mtim.Nano(),
+		Xattrs: xattrs,
+	}, nil
+}
+
+// setAttrs sets the attributes read by readAttrs on dst
+func setAttrs(attrs *direntAttrs, dst string) error {
+	if attrs == nil {
+		return fmt.Errorf("attributes of %s haven't been recorded", dst)
+	}
+
+	if err := os.Lchown(dst, attrs.Uid, attrs.Gid); err != nil {
+		return err
+	}
+
+	if err := beneath.Chmod(dst, attrs.Mode); err != nil {
+		return err
+	}
+
+	if err := fscopy.SetXattrs(dst, attrs.Xattrs); err != nil {
+		return err
+	}
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(attrs.Atime),
+		unix.NsecToTimespec(attrs.Mtime),
+	}
+
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// moveAside renames target to old, unless it's been done already
+func moveAside(target, old string) error {
+	hasOld, err := lexists(old)
+	if err != nil || hasOld {
+		return err
+	}
+
+	if err = os.Rename(target, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
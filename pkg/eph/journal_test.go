@@ -0,0 +1,69 @@
+package eph
+
+import (
+	"github.com/gman0/eph/pkg/layout"
+	"os"
+	"path"
+	"testing"
+)
+
+// Hardlinks added by separate ops are merged as links to the same inode
+func TestMergeKeepsLinksAcrossOps(t *testing.T) {
+	var (
+		tmp   = tempDir(t)
+		p     = path.Join(tmp, "target")
+		orig  = layout.Orig(p)
+		upper = path.Join(tmp, "upper")
+	)
+
+	mustMkdir(t, p, 0755)
+	mustMkdir(t, layout.Base(p), 0755)
+	mustMkdir(t, orig, 0755)
+
+	mustMkdir(t, upper, 0755)
+	mustMkdir(t, path.Join(upper, "a"), 0755)
+	mustWriteFile(t, path.Join(upper, "a", "f"), "linked")
+
+	for _, link := range []string{"g", "h"} {
+		if err := os.Link(path.Join(upper, "a", "f"), path.Join(upper, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j := &mergeJournal{
+		Phase: mergePhaseStaging,
+		Mode:  mergeModeMerge,
+		Dest:  orig,
+		Ops: []mergeOp{
+			{Kind: mergeAdd, Path: "a", Source: path.Join(upper, "a"), Dir: true},
+			{Kind: mergeAdd, Path: "g", Source: path.Join(upper, "g")},
+			{Kind: mergeAdd, Path: "h", Source: path.Join(upper, "h")},
+		},
+	}
+
+	journalPath := layout.MergeJournal(p)
+
+	if err := j.write(journalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.run(journalPath, ""); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	first, err := os.Lstat(path.Join(orig, "a", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, link := range []string{"g", "h"} {
+		info, err := os.Lstat(path.Join(orig, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !os.SameFile(first, info) {
+			t.Errorf("%s isn't linked to a/f", link)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/output"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Problems found with a ramdisk by eph list
+const (
+	// The overlay isn't mounted over the target, e.g. after a failed merge
+	problemOverlayUnmounted = "overlay-unmounted"
+	// The tmpfs holding the ramdisk's data isn't mounted
+	problemStagingUnmounted = "staging-unmounted"
+	// The read-only view of the original data or the applied snapshot
+	// isn't mounted
+	problemHeadUnmounted     = "head-unmounted"
+	problemSnapshotUnmounted = "snapshot-unmounted"
+	problemStateUnreadable   = "state-unreadable"
+	// A merge has been interrupted and needs to be resumed or aborted
+	problemMergeInProgress = "merge-in-progress"
+	// There's no space left in the ramdisk
+	problemFull = "full"
+)
+
+// ramdiskEntry describes a ramdisk found by eph list
+type ramdiskEntry struct {
+	// Target is empty if the overlay isn't mounted and the eph root
+	// doesn't have the default name
+	Target          string    `json:"target"`
+	EphRoot         string    `json:"eph_root"`
+	Quota           quotaInfo `json:"quota"`
+	AppliedSnapshot int       `json:"applied_snapshot"`
+	Snapshots       int       `json:"snapshots"`
+	Healthy         bool      `json:"healthy"`
+	Problems        []string  `json:"problems"`
+}
+
+// PrintRamdisks lists all ramdisks on the host. They are found among the
+// mounted filesystems: overlays whose upper layer is in an eph root, and
+// ramdisks mounted in eph roots whose overlay isn't mounted anymore.
+func PrintRamdisks() error {
+	mounts, err := device.Mounts()
+	if err != nil {
+		return fmt.Errorf("failed to read mounts: %v", err)
+	}
+
+	// Mount points of the filesystems visible on top of them
+	mounted := make(map[string]device.Mount)
+
+	for _, m := range mounts {
+		mounted[m.MountPoint] = m
+	}
+
+	var entries []ramdiskEntry
+
+	for base, target := range mountedEphs(mounts) {
+		entries = append(entries, inspectRamdisk(base, target, mounted))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Target != entries[j].Target {
+			return entries[i].Target < entries[j].Target
+		}
+		return entries[i].EphRoot < entries[j].EphRoot
+	})
+
+	switch output.Format {
+	case output.JSON:
+		if entries == nil {
+			entries = []ramdiskEntry{}
+		}
+
+		return output.WriteJSON(entries)
+	case output.Porcelain:
+		w := output.NewWriter()
+
+		// Each ramdisk starts with its target record
+		for _, e := range entries {
+			w.Record("target", output.Quote(e.Target))
+			w.Record("eph-root", output.Quote(e.EphRoot))
+			writeQuotaRecord(w, e.Quota)
+			w.Record("snapshots", strconv.Itoa(e.AppliedSnapshot), strconv.Itoa(e.Snapshots))
+			w.Record("health", healthStr(&e))
+		}
+
+		return w.Flush()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "TARGET\tEPH ROOT\tQUOTA\tUSED\tSNAPSHOT\tSNAPSHOTS\tHEALTH")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", coalesceStr(e.Target), e.EphRoot,
+			humanBytes(e.Quota.Size), humanBytes(e.Quota.Used), e.AppliedSnapshot, e.Snapshots, healthStr(&e))
+	}
+
+	return w.Flush()
+}
+
+// mountedEphs finds the ramdisks among mounts and returns their targets
+// by their eph roots. The target is empty if the overlay isn't mounted.
+func mountedEphs(mounts []device.Mount) map[string]string {
+	targets := make(map[string]string)
+
+	for _, m := range mounts {
+		switch m.FsType {
+		case "overlay":
+			if base, ok := layout.BaseOfOverlayDiff(m.Options["upperdir"]); ok {
+				targets[base] = m.MountPoint
+			}
+		case "tmpfs":
+			if base, ok := layout.BaseOfStaging(m.MountPoint); ok {
+				if _, found := targets[base]; !found {
+					targets[base] = ""
+				}
+			}
+		}
+	}
+
+	return targets
+}
+
+// inspectRamdisk checks that all parts of the ramdisk with eph root base
+// are in place. Its overlay is mounted at target, or not at all if empty.
+func inspectRamdisk(base, target string, mounted map[string]device.Mount) ramdiskEntry {
+	e := ramdiskEntry{Target: target, EphRoot: base}
+
+	if target == "" {
+		e.Target = layout.TargetOf(base)
+		e.Problems = append(e.Problems, problemOverlayUnmounted)
+	}
+
+	// Ramdisks created with --eph-root are found in their eph root
+	// just the same, the layout paths are derived from it
+	staging := layout.StagingIn(base)
+
+	if m, ok := mounted[staging]; !ok || m.FsType != "tmpfs" {
+		e.Problems = append(e.Problems, problemStagingUnmounted)
+	} else if quota, err := readQuota(staging); err == nil {
+		e.Quota = quota
+
+		if quota.Available == 0 {
+			e.Problems = append(e.Problems, problemFull)
+		}
+	}
+
+	if _, ok := mounted[layout.HeadIn(base)]; !ok {
+		e.Problems = append(e.Problems, problemHeadUnmounted)
+	}
+
+	if _, err := os.Lstat(layout.MergeJournalIn(base)); err == nil {
+		e.Problems = append(e.Problems, problemMergeInProgress)
+	}
+
+	if ss, err := readSnapshotsState(layout.SnapshotsStateIn(base)); err != nil {
+		e.Problems = append(e.Problems, problemStateUnreadable)
+	} else {
+		e.AppliedSnapshot = ss.AppliedSnapshot
+		e.Snapshots = len(ss.Snapshots)
+
+		if snapLayers, err := listHeadLayersForSnapshot(ss.AppliedSnapshot, ss); err != nil {
+			e.Problems = append(e.Problems, problemStateUnreadable)
+		} else {
+			for _, id := range snapLayers {
+				if _, ok := mounted[path.Join(layout.SnapshotMountsIn(base), layout.SnapshotMountpointTarget(id))]; !ok {
+					e.Problems = append(e.Problems, problemSnapshotUnmounted)
+					break
+				}
+			}
+		}
+	}
+
+	e.Healthy = len(e.Problems) == 0
+	if e.Problems == nil {
+		e.Problems = []string{}
+	}
+
+	return e
+}
+
+func healthStr(e *ramdiskEntry) string {
+	if e.Healthy {
+		return "ok"
+	}
+
+	return strings.Join(e.Problems, ",")
+}
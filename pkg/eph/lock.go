@@ -0,0 +1,70 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"os"
+)
+
+// lockEph keeps other eph processes off ramdisk p: commands that change
+// the ramdisk take an exclusive lock, the ones that only read it a shared one.
+// The lock file lives in eph root and is removed along with it.
+func lockEph(p string, mode lock.Mode) (*lock.Lock, error) {
+	return lockEphRoot(layout.Base(p), p, mode)
+}
+
+// lockEphRoot locks ramdisk p with eph root base
+func lockEphRoot(base, p string, mode lock.Mode) (*lock.Lock, error) {
+	l, err := acquireLock(layout.LockIn(base), p, mode)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("eph root %s does not exist", base)
+	}
+
+	return l, err
+}
+
+// lockBackups keeps other undo-merges off the merge backups of p.
+// The lock file is removed along with the backups directory.
+func lockBackups(p string) (*lock.Lock, error) {
+	l, err := acquireLock(layout.BackupsLock(p), p, lock.Exclusive)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no merge backups found for %s", p)
+	}
+
+	return l, err
+}
+
+// acquireLock locks ramdisk p with the lock file at lockPath.
+// os.IsNotExist errors are returned as they are.
+func acquireLock(lockPath, p string, mode lock.Mode) (*lock.Lock, error) {
+	l, err := lock.Acquire(lockPath, mode, func(holder string) {
+		fmt.Fprintf(os.Stderr, "waiting for %s to release ramdisk %s\n", holder, p)
+	})
+
+	if err == nil {
+		return l, nil
+	}
+
+	if heldErr, ok := err.(*lock.HeldError); ok {
+		if heldErr.TimedOut {
+			return nil, fmt.Errorf("timed out waiting for %s to release ramdisk %s", heldErr.Holder, p)
+		}
+		return nil, fmt.Errorf("ramdisk %s is locked by %s, use --wait or --timeout to wait for it", p, heldErr.Holder)
+	}
+
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("failed to lock ramdisk %s: %v", p, err)
+}
+
+// removeLock removes the lock file in eph root base before it's removed
+func removeLock(base string) error {
+	if err := os.Remove(layout.LockIn(base)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lock file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package eph
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/layout"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Changes made in the source directory of a --target ramdisk
+	// since it was created make the merge fail
+	StrategyFail = "fail"
+	// Changes in the ramdisk overwrite those made in the source directory
+	StrategyOurs = "ours"
+	// Changes made in the source directory are kept, conflicting
+	// changes in the ramdisk are not merged
+	StrategyTheirs = "theirs"
+)
+
+// sourceManifest records the state of the source directory of a --target
+// ramdisk, which may be modified by others while the ramdisk is in use.
+type sourceManifest struct {
+	Hashed  bool                     `json:"hashed,omitempty"`
+	Entries map[string]manifestEntry `json:"entries"`
+
+	// Sorted keys of Entries
+	paths []string
+}
+
+type manifestEntry struct {
+	Mode  os.FileMode `json:"mode"`
+	Size  int64       `json:"size"`
+	Mtime int64       `json:"mtime"`
+	Ino   uint64      `json:"ino"`
+	Hash  string      `json:"hash,omitempty"`
+}
+
+func newManifestEntry(info os.FileInfo) manifestEntry {
+	st := info.Sys().(*syscall.Stat_t)
+
+	return manifestEntry{
+		Mode:  info.Mode(),
+		Size:  info.Size(),
+		Mtime: info.ModTime().UnixNano(),
+		Ino:   st.Ino,
+	}
+}
+
+// recordSourceManifest walks the whole source directory and records
+// its contents. Hashing file contents lets the merge tell touched
+// files from the ones that have actually changed.
+func recordSourceManifest(source string, hashed bool) (*sourceManifest, error) {
+	m := &sourceManifest{
+		Hashed:  hashed,
+		Entries: make(map[string]manifestEntry),
+	}
+
+	iter, err := diriter.NewRecursiveIter(source)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	for !iter.AtEnd() {
+		p := path.Join(iter.Base(), iter.FileInfo().Name())
+
+		if len(p) > len(source) {
+			e := newManifestEntry(iter.FileInfo())
+
+			if hashed && e.Mode.IsRegular() {
+				if e.Hash, err = hashFile(p); err != nil {
+					return nil, err
+				}
+			}
+
+			m.Entries[p[len(source):]] = e
+		}
+
+		if iter.Increment(); iter.Err() != nil {
+			return nil, iter.Err()
+		}
+	}
+
+	return m, nil
+}
+
+// refreshSourceManifest records the source directory of a --target ramdisk
+// once more, after the ramdisk's changes have been merged into it
+func refreshSourceManifest(p string) error {
+	manifestPath := layout.SourceManifest(p)
+
+	m, err := readSourceManifest(manifestPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	source, err := os.Readlink(layout.Orig(p))
+	if err != nil {
+		return err
+	}
+
+	if m, err = recordSourceManifest(source, m.Hashed); err != nil {
+		return err
+	}
+
+	return m.write(manifestPath)
+}
+
+func (m *sourceManifest) write(p string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b, 0600)
+}
+
+func readSourceManifest(p string) (*sourceManifest, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &sourceManifest{}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+
+	m.paths = make([]string, 0, len(m.Entries))
+	for p := range m.Entries {
+		m.paths = append(m.paths, p)
+	}
+
+	sort.Strings(m.paths)
+
+	return m, nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// changed checks whether relPath has changed in source since the manifest
+// was recorded. If subtree is set, all of its descendants are checked too.
+func (m *sourceManifest) changed(source, relPath string, subtree bool) (bool, error) {
+	info, err := os.Lstat(source + relPath)
+	if err != nil && !isNotExist(err) {
+		return false, err
+	}
+
+	e, recorded := m.Entries[relPath]
+
+	if err != nil || !recorded {
+		// Added or deleted in source
+		return (err == nil) != recorded, nil
+	}
+
+	if changed, err := m.entryChanged(source+relPath, &e, info); changed || err != nil {
+		return changed, err
+	}
+
+	if !subtree || !info.IsDir() {
+		return false, nil
+	}
+
+	iter, err := diriter.NewRecursiveIter(source + relPath)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+
+	var found int
+
+	for !iter.AtEnd() {
+		p := path.Join(iter.Base(), iter.FileInfo().Name())
+
+		if len(p) > len(source+relPath) {
+			e, recorded := m.Entries[p[len(source):]]
+			if !recorded {
+				return true, nil
+			}
+
+			if changed, err := m.entryChanged(p, &e, iter.FileInfo()); changed || err != nil {
+				return changed, err
+			}
+
+			found++
+		}
+
+		if iter.Increment(); iter.Err() != nil {
+			return false, iter.Err()
+		}
+	}
+
+	// Some of the recorded descendants are gone
+	return found != m.countUnder(relPath), nil
+}
+
+func (m *sourceManifest) entryChanged(p string, e *manifestEntry, info os.FileInfo) (bool, error) {
+	cur := newManifestEntry(info)
+
+	if cur.Mode != e.Mode {
+		return true, nil
+	}
+
+	if info.IsDir() {
+		// Directory timestamps change with any change of their contents,
+		// which are compared separately
+		return false, nil
+	}
+
+	if cur.Size == e.Size && cur.Mtime == e.Mtime && cur.Ino == e.Ino {
+		return false, nil
+	}
+
+	if e.Hash == "" || !info.Mode().IsRegular() {
+		return true, nil
+	}
+
+	hash, err := hashFile(p)
+	if err != nil {
+		return false, err
+	}
+
+	return hash != e.Hash, nil
+}
+
+func (m *sourceManifest) countUnder(relPath string) int {
+	prefix := relPath + "/"
+
+	i := sort.SearchStrings(m.paths, prefix)
+	n := 0
+
+	for ; i < len(m.paths) && strings.HasPrefix(m.paths[i], prefix); i++ {
+		n++
+	}
+
+	return n
+}
+
+// resolveConflicts finds ops whose targets have changed in source since
+// the manifest was recorded, and resolves them according to strategy.
+// Conflicting paths are returned along with the resolved ops.
+func (m *sourceManifest) resolveConflicts(source string, ops []mergeOp, strategy string) ([]mergeOp, []string, error) {
+	var (
+		resolved  = make([]mergeOp, 0, len(ops))
+		conflicts []string
+		// Shallow directories left out of the merge,
+		// their nested ops are left out as well
+		dropped = make(map[string]bool)
+		// Renamed directories left out of the merge, ops
+		// of their contents are left out as well
+		droppedRenames = make(map[string]bool)
+		renamedDirs    = renamedDirOps(ops)
+	)
+
+	for _, op := range ops {
+		if op.Nested && dropped[path.Dir(op.Path)] {
+			dropped[op.Path] = true
+			continue
+		}
+
+		if len(droppedRenames) > 0 && hasAncestorIn(op.Path, droppedRenames) {
+			continue
+		}
+
+		if op.Nested {
+			// The parent didn't exist in source, it's been checked already
+			resolved = append(resolved, op)
+			continue
+		}
+
+		subtree := op.Kind != mergeAttr && !op.Shallow
+
+		// Contents of renamed directories are still at the original paths in source
+		changed, err := m.changed(source, origLocation(ops, renamedDirs, op.Path), subtree)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !changed && op.Kind == mergeRename {
+			// The original version is moved along with its contents
+			if changed, err = m.changed(source, origLocation(ops, renamedDirs, op.From), true); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if changed {
+			conflicts = append(conflicts, op.Path)
+
+			if strategy == StrategyTheirs {
+				dropped[op.Path] = true
+				if op.Kind == mergeRename && op.Dir {
+					droppedRenames[op.Path] = true
+				}
+				continue
+			}
+		}
+
+		resolved = append(resolved, op)
+	}
+
+	if len(conflicts) > 0 && (strategy == StrategyFail || strategy == "") {
+		msg := fmt.Sprintf("%d paths have changed in %s since the ramdisk was created:", len(conflicts), source)
+		for _, p := range conflicts {
+			msg += "\n  C " + p[1:]
+		}
+
+		return nil, conflicts, fmt.Errorf("%s\nuse --strategy ours to overwrite them, or --strategy theirs to keep them", msg)
+	}
+
+	return resolved, conflicts, nil
+}
+
+func hasAncestorIn(relPath string, dirs map[string]bool) bool {
+	for p := path.Dir(relPath); p != "/"; p = path.Dir(p) {
+		if dirs[p] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,724 @@
+package eph
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"os"
+	"path"
+	"syscall"
+)
+
+type MergeOptions struct {
+	// NoBackup disables backing up the original data overwritten by the merge
+	NoBackup bool
+	// DryRun only lists the changes that would be merged
+	DryRun bool
+	// PlanFile is where the list of changes is written to, implies DryRun
+	PlanFile string
+	// ApplyPlanFile is a previously written plan file. The merge
+	// is refused if the ramdisk has changed since then.
+	ApplyPlanFile string
+	// Paths limits the merge to the changes under these paths,
+	// relative to the ramdisk
+	Paths []string
+	// Exclude lists glob patterns of paths left out of the merge
+	Exclude []string
+	// Into is the directory the changes are written into instead of orig.
+	// orig and the ramdisk are left untouched.
+	Into string
+	// Strategy resolves conflicts with changes made in the source
+	// directory of a --target ramdisk, one of Strategy* constants.
+	// Defaults to StrategyFail.
+	Strategy string
+	// Checksum compares the contents of files copied up into the ramdisk
+	// against orig, and leaves out the ones that haven't changed
+	Checksum bool
+}
+
+type mergeMode string
+
+const (
+	// All changes are merged and the ramdisk is unmounted
+	mergeModeMerge mergeMode = ""
+	// All changes are merged and the ramdisk is reset
+	mergeModeCommit mergeMode = "commit"
+	// Selected changes are merged and dropped from the ramdisk
+	mergeModePartial mergeMode = "partial"
+	// Changes are written into another directory, the ramdisk is left as is
+	mergeModeInto mergeMode = "into"
+)
+
+func (m mergeMode) cmdName() string {
+	if m == mergeModeCommit {
+		return "commit"
+	}
+	return "merge"
+}
+
+func Merge(p string, opts MergeOptions) error {
+	mode := mergeModeMerge
+	if opts.Into != "" {
+		mode = mergeModeInto
+	} else if len(opts.Paths) > 0 || len(opts.Exclude) > 0 {
+		mode = mergeModePartial
+	}
+
+	return merge(p, opts, mode)
+}
+
+func merge(p string, opts MergeOptions, mode mergeMode) error {
+	var (
+		base        = layout.Base(p)
+		journalPath = layout.MergeJournal(p)
+	)
+
+	if err := checkTargetAndBaseDirs(p, base); err != nil {
+		return err
+	}
+
+	lockMode := lock.Exclusive
+	if opts.DryRun || opts.PlanFile != "" {
+		// Only planning the merge, the ramdisk is left as it is
+		lockMode = lock.Shared
+	}
+
+	l, err := lockEph(p, lockMode)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	if _, err := layout.PathShouldNotExist(journalPath); err != nil {
+		return fmt.Errorf("another merge is in progress, use --resume or --abort to finish it: %v", err)
+	}
+
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	layers, err := snapshotLayers(ss, p)
+	if err != nil {
+		return err
+	}
+
+	ign, err := loadIgnore(layers, layout.Orig(p))
+	if err != nil {
+		return fmt.Errorf("failed to read ignore rules: %v", err)
+	}
+
+	filter, err := newMergeFilter(opts.Paths, opts.Exclude, ign)
+	if err != nil {
+		return err
+	}
+
+	switch opts.Strategy {
+	case "", StrategyFail, StrategyOurs, StrategyTheirs:
+	default:
+		return fmt.Errorf("unknown conflict strategy %s", opts.Strategy)
+	}
+
+	var manifest *sourceManifest
+	if opts.Into != "" {
+		if err = checkMergeInto(p, opts.Into); err != nil {
+			return err
+		}
+	} else if manifest, err = readSourceManifest(layout.SourceManifest(p)); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read source manifest: %v", err)
+		}
+		manifest = nil
+	}
+
+	planOps := func() ([]mergeOp, []string, error) {
+		ops, err := planMerge(layers, layout.Orig(p), filter, opts.Checksum)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if opts.Into != "" {
+			ops, err = retargetOps(ops, opts.Into)
+			return ops, nil, err
+		}
+
+		if manifest == nil {
+			return ops, nil, nil
+		}
+
+		source, err := os.Readlink(layout.Orig(p))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return manifest.resolveConflicts(source, ops, opts.Strategy)
+	}
+
+	if opts.DryRun || opts.PlanFile != "" {
+		return planOnly(p, planOps, opts)
+	}
+
+	var plan *mergePlan
+	if opts.ApplyPlanFile != "" {
+		if plan, err = readMergePlan(opts.ApplyPlanFile); err != nil {
+			return fmt.Errorf("failed to read merge plan: %v", err)
+		}
+
+		if plan.Target != p {
+			return fmt.Errorf("merge plan was made for %s", plan.Target)
+		}
+	}
+
+	if mode == mergeModeMerge {
+		return mergeOffline(p, planOps, plan, opts)
+	}
+
+	return mergeOnline(p, planOps, plan, opts, mode)
+}
+
+// opsPlanner lists the ops merging the ramdisk,
+// along with the conflicts resolved on the way
+type opsPlanner func() (ops []mergeOp, conflicts []string, err error)
+
+// mergeOffline unmounts the overlay and merges all changes into orig
+func mergeOffline(p string, planOps opsPlanner, plan *mergePlan, opts MergeOptions) error {
+	journalPath := layout.MergeJournal(p)
+
+	if err := device.Unmount(p); err != nil {
+		return fmt.Errorf("failed to unmount overlay %s: %v", p, err)
+	}
+
+	if err := os.Remove(p); err != nil {
+		return fmt.Errorf("failed to remove overlay mount point %s: %v", p, err)
+	}
+
+	// Nothing has been written to orig yet, so in case of an error
+	// we can simply put the overlay back in place.
+	abort := func(err error) error {
+		if mountErr := mountOverlay(p); mountErr != nil {
+			return fmt.Errorf("%v\n  failed to remount overlay: %v", err, mountErr)
+		}
+		return err
+	}
+
+	ops, conflicts, err := planOps()
+	if err != nil {
+		return abort(err)
+	}
+
+	if plan != nil {
+		if err = plan.matches(ops); err != nil {
+			return abort(fmt.Errorf("ramdisk has changed since the merge plan was made: %v", err))
+		}
+	}
+
+	if err = printMergeOps(ops, conflicts, opts.Strategy, false); err != nil {
+		return abort(err)
+	}
+
+	j, err := newMergeJournal(p, ops, mergeModeMerge, opts)
+	if err != nil {
+		return abort(err)
+	}
+
+	if err = j.write(journalPath); err != nil {
+		return abort(fmt.Errorf("failed to write merge journal: %v", err))
+	}
+
+	return runMerge(p, j)
+}
+
+// mergeOnline merges changes while keeping the ramdisk.
+//
+// The changes are copied next to orig while the overlay is still mounted.
+// The overlay is then unmounted only for as long as it takes to rename
+// them into place and to remount the overlay. Merging into another
+// directory doesn't need to unmount the overlay at all.
+func mergeOnline(p string, planOps opsPlanner, plan *mergePlan, opts MergeOptions, mode mergeMode) error {
+	journalPath := layout.MergeJournal(p)
+
+	ops, conflicts, err := planOps()
+	if err != nil {
+		return err
+	}
+
+	if plan != nil {
+		if err = plan.matches(ops); err != nil {
+			return fmt.Errorf("ramdisk has changed since the merge plan was made: %v", err)
+		}
+	}
+
+	j, err := newMergeJournal(p, ops, mode, opts)
+	if err != nil {
+		return err
+	}
+
+	// The overlay is still mounted and orig is left untouched while staging,
+	// so any failure here is simply reverted
+	abortStaging := func(err error) error {
+		j.abort()
+		os.Remove(journalPath)
+		return err
+	}
+
+	if err = j.write(journalPath); err != nil {
+		return abortStaging(fmt.Errorf("failed to write merge journal: %v", err))
+	}
+
+	if mode == mergeModeInto {
+		if err = printMergeOps(j.Ops, conflicts, opts.Strategy, false); err != nil {
+			return abortStaging(err)
+		}
+		return runMerge(p, j)
+	}
+
+	if err = j.run(journalPath, mergePhaseCommit); err != nil {
+		if err == errInterrupted {
+			// The changes can't be staged again without checking the ramdisk,
+			// which is done by merging anew
+			return abortStaging(fmt.Errorf("%s interrupted, nothing has been merged", mode.cmdName()))
+		}
+		return abortStaging(fmt.Errorf("%s failed: %v", mode.cmdName(), err))
+	}
+
+	if err = device.Unmount(p); err != nil {
+		return abortStaging(fmt.Errorf("failed to unmount overlay %s: %v", p, err))
+	}
+
+	// The ramdisk may have been modified while staging. If that's the case,
+	// drop the staged changes and stage them again, now that it's unmounted.
+	if ops, conflicts, err = planOps(); err == nil && plan != nil {
+		if err = plan.matches(ops); err != nil {
+			err = fmt.Errorf("ramdisk has changed since the merge plan was made: %v", err)
+		}
+	}
+
+	if err == nil {
+		err = printMergeOps(ops, conflicts, opts.Strategy, false)
+	}
+
+	if err != nil {
+		err = abortStaging(err)
+		if mountErr := mountOverlay(p); mountErr != nil {
+			return fmt.Errorf("%v\n  failed to remount overlay: %v", err, mountErr)
+		}
+		return err
+	}
+
+	if matchOps(j.Ops, ops) != nil {
+		// Nothing has been committed yet, only the staged copies need to be removed
+		j.Phase = mergePhaseStaging
+		if err = j.abort(); err != nil {
+			return fmt.Errorf("failed to drop staged changes: %v", err)
+		}
+
+		j.Ops = ops
+		j.Done = 0
+		j.opsByPath = nil
+
+		if err = j.write(journalPath); err != nil {
+			return fmt.Errorf("failed to update merge journal: %v", err)
+		}
+	}
+
+	return runMerge(p, j)
+}
+
+func newMergeJournal(p string, ops []mergeOp, mode mergeMode, opts MergeOptions) (*mergeJournal, error) {
+	j := &mergeJournal{
+		Phase: mergePhaseStaging,
+		Mode:  mode,
+		Dest:  layout.Orig(p),
+		Ops:   ops,
+	}
+
+	if mode == mergeModeInto {
+		j.Dest = opts.Into
+	}
+
+	if !opts.NoBackup && len(ops) > 0 {
+		// Backups of a merge into another directory are stored next to it,
+		// so that it can be reverted with undo-merge as well
+		backupsOf := p
+		if mode == mergeModeInto {
+			backupsOf = opts.Into
+		}
+
+		var err error
+		if j.Backup, err = newBackupPrefix(backupsOf); err != nil {
+			return nil, err
+		}
+
+		// orig is moved back to p once merged, or it's a symlink
+		// to the source directory in case of a --target ramdisk
+		j.BackupDest = p
+		if mode == mergeModeInto {
+			j.BackupDest = opts.Into
+		} else if source, err := os.Readlink(j.Dest); err == nil {
+			j.BackupDest = source
+		}
+	}
+
+	return j, nil
+}
+
+// ResumeMerge finishes an interrupted or failed merge.
+func ResumeMerge(p string) error {
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	j, err := readMergeJournalOf(p)
+	if err != nil {
+		return err
+	}
+
+	return runMerge(p, j)
+}
+
+// AbortMerge reverts all changes made to orig by an interrupted
+// or failed merge and mounts the overlay back.
+func AbortMerge(p string) error {
+	journalPath := layout.MergeJournal(p)
+
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	j, err := readMergeJournalOf(p)
+	if err != nil {
+		return err
+	}
+
+	if j.Phase == mergePhaseCleanup {
+		return errors.New("all changes have already been written, the merge can only be resumed")
+	}
+
+	if err = j.abort(); err != nil {
+		return fmt.Errorf("failed to abort merge: %v", err)
+	}
+
+	if err = os.Remove(journalPath); err != nil {
+		return fmt.Errorf("failed to remove merge journal %s: %v", journalPath, err)
+	}
+
+	if j.Mode == mergeModeInto {
+		// The overlay is still mounted
+		return nil
+	}
+
+	if err = mountOverlay(p); err != nil {
+		return fmt.Errorf("failed to mount overlay: %v", err)
+	}
+
+	return nil
+}
+
+func readMergeJournalOf(p string) (*mergeJournal, error) {
+	if isNotExist, err := layout.DirectoryShouldExist(layout.Base(p)); err != nil {
+		if isNotExist {
+			return nil, fmt.Errorf("eph root %s does not exist", layout.Base(p))
+		}
+		return nil, err
+	}
+
+	j, err := readMergeJournal(layout.MergeJournal(p))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no merge in progress for %s", p)
+		}
+		return nil, fmt.Errorf("failed to read merge journal: %v", err)
+	}
+
+	return j, nil
+}
+
+func runMerge(p string, j *mergeJournal) error {
+	journalPath := layout.MergeJournal(p)
+
+	if err := j.run(journalPath, ""); err != nil {
+		cmdName := j.Mode.cmdName()
+		if err == errInterrupted {
+			return fmt.Errorf("%s interrupted\n  recovery:\n    resume: eph %s --resume %s\n    abort:  eph %s --abort %s", cmdName, cmdName, p, cmdName, p)
+		}
+		return fmt.Errorf("%s failed: %v\n  recovery:\n    resume: eph %s --resume %s\n    abort:  eph %s --abort %s", cmdName, err, cmdName, p, cmdName, p)
+	}
+
+	if j.Mode == mergeModePartial {
+		// Merged changes are dropped from the ramdisk before the journal
+		// is removed, so that this is repeated by --resume should it fail
+		if err := dropMergedChanges(p, j); err != nil {
+			return fmt.Errorf("failed to drop merged changes from the ramdisk: %v\n  recovery:\n    resume: eph merge --resume %s", err, p)
+		}
+	}
+
+	if j.Mode == mergeModeCommit || j.Mode == mergeModePartial {
+		if err := refreshSourceManifest(p); err != nil {
+			return fmt.Errorf("failed to update source manifest: %v", err)
+		}
+	}
+
+	if err := os.Remove(journalPath); err != nil {
+		return fmt.Errorf("failed to remove merge journal %s: %v", journalPath, err)
+	}
+
+	switch j.Mode {
+	case mergeModeCommit:
+		return finishCommit(p)
+	case mergeModePartial:
+		return mountOverlay(p)
+	case mergeModeInto:
+		return nil
+	}
+
+	return destroyEph(p, false)
+}
+
+// planMerge lists all operations needed to write the ramdisk layers into orig.
+// Only the changes selected by filter are included, all of them if it's nil.
+// checksum leaves out files whose contents haven't changed.
+func planMerge(layers []string, orig string, filter *mergeFilter, checksum bool) ([]mergeOp, error) {
+	ops, ancestors, r, err := planOps(layers, orig, filter, checksum, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.hidden) > 0 {
+		// Files have been moved into added directories, those
+		// are merged one by one so that the files can be renamed
+		if ops, ancestors, r, err = planOps(layers, orig, filter, checksum, r.expandDirs()); err != nil {
+			return nil, err
+		}
+	}
+
+	ops = applyRenames(ops, r)
+
+	if len(ancestors) == 0 {
+		return ops, nil
+	}
+
+	return pruneEmptyAncestors(ops, ancestors), nil
+}
+
+// planOps walks the changes and lists the ops merging them, along with
+// the shallow directories merged only as ancestors of selected paths.
+// Added directories in expand are merged shallow.
+func planOps(layers []string, orig string, filter *mergeFilter, checksum bool, expand map[string]bool) ([]mergeOp, map[string]bool, *renames, error) {
+	var (
+		ops []mergeOp
+		// Paths of shallow directories, their children are nested ops
+		shallow = make(map[string]bool)
+		// Shallow and renamed directories that are merged only
+		// because they lead to a selected path
+		ancestors = make(map[string]bool)
+		rd        = renameDetector{orig: orig}
+	)
+
+	err := walkChanges(layers, orig, checksum, func(c *change) error {
+		if filter.ignored(c) {
+			c.prune = true
+			return nil
+		}
+
+		selected, isAncestor := filter.match(c.relPath)
+		if !selected && !isAncestor {
+			c.prune = true
+			return nil
+		}
+
+		rd.add(c)
+
+		op := mergeOp{
+			Path:   c.relPath,
+			Source: c.stagingPath(),
+			Dir:    c.info.IsDir(),
+			Nested: shallow[path.Dir(c.relPath)],
+		}
+
+		switch c.status {
+		case statusSkip:
+			return nil
+		case statusAdded:
+			op.Kind = mergeAdd
+		case statusDeleted:
+			if !selected {
+				return nil
+			}
+
+			op.Kind = mergeDelete
+			op.Source = ""
+		case statusModified, statusMetadata:
+			if c.info.IsDir() && !c.isWhole() {
+				if !selected {
+					// Only the path to a selected change
+					return nil
+				}
+
+				op.Kind = mergeAttr
+				setOrigAttrs(&op, c.origInfo)
+			} else {
+				op.Kind = mergeReplace
+				op.Meta = c.status == statusMetadata
+			}
+		case statusRenamed:
+			// Renamed directories are moved in orig, their contents
+			// are then merged into them one by one
+			op.Kind = mergeRename
+			op.From = c.origPath
+			op.Nested = false
+			setOrigAttrs(&op, c.origInfo)
+			ancestors[op.Path] = !selected
+
+			if err := setOpStats(&op, ""); err != nil {
+				return err
+			}
+
+			ops = append(ops, op)
+			return nil
+		}
+
+		if op.Dir && op.Kind != mergeAttr {
+			// New directories that aren't selected as a whole, or whose
+			// contents come from multiple layers, are created empty,
+			// and their contents are then merged one by one
+			selectsAll, err := filter.selectsAll(c.relPath, op.Source)
+			if err != nil {
+				return err
+			}
+
+			if !selected || !selectsAll || c.isComposite() || expand[c.relPath] {
+				op.Shallow = true
+				shallow[op.Path] = true
+				ancestors[op.Path] = !selected
+				c.expand = true
+			}
+		} else if !selected {
+			return nil
+		}
+
+		if err := setOpStats(&op, orig+c.origPath); err != nil {
+			return err
+		}
+
+		ops = append(ops, op)
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	r, err := rd.detect()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return ops, ancestors, r, nil
+}
+
+// applyRenames turns the ops adding renamed files into renames, and drops
+// the deletions of the original versions of renamed files and directories
+func applyRenames(ops []mergeOp, r *renames) []mergeOp {
+	moved := make(map[string]bool)
+
+	for i := range ops {
+		op := &ops[i]
+
+		if op.Kind == mergeRename {
+			moved[op.From] = true
+			continue
+		}
+
+		d := r.from[op.Path]
+		if op.Kind != mergeAdd || d == nil {
+			continue
+		}
+
+		op.Kind = mergeRename
+		op.From = d.relPath
+		op.Nested = false
+		op.Files, op.Bytes = 0, 0
+		setOrigAttrs(op, d.origInfo)
+
+		moved[op.From] = true
+	}
+
+	if len(moved) == 0 {
+		return ops
+	}
+
+	renamed := make([]mergeOp, 0, len(ops))
+	for _, op := range ops {
+		if op.Kind != mergeDelete || !moved[op.Path] {
+			renamed = append(renamed, op)
+		}
+	}
+
+	return renamed
+}
+
+// setOrigAttrs records the original attributes of the op's target
+// so that it can be reverted
+func setOrigAttrs(op *mergeOp, origInfo os.FileInfo) {
+	st := origInfo.Sys().(*syscall.Stat_t)
+	op.Mode = origInfo.Mode()
+	op.Uid = int(st.Uid)
+	op.Gid = int(st.Gid)
+}
+
+// pruneEmptyAncestors drops shallow directories leading
+// to selected paths that turned out to have no changes
+func pruneEmptyAncestors(ops []mergeOp, ancestors map[string]bool) []mergeOp {
+	var (
+		pruned      = make([]mergeOp, 0, len(ops))
+		hasChildren = make(map[string]bool)
+	)
+
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ancestors[ops[i].Path] && !hasChildren[ops[i].Path] {
+			continue
+		}
+
+		hasChildren[path.Dir(ops[i].Path)] = true
+		pruned = append(pruned, ops[i])
+	}
+
+	for i, j := 0, len(pruned)-1; i < j; i, j = i+1, j-1 {
+		pruned[i], pruned[j] = pruned[j], pruned[i]
+	}
+
+	return pruned
+}
+
+// mountOverlay mounts the overlay back after it's been unmounted by a merge.
+func mountOverlay(p string) error {
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		origInfo, err := os.Stat(layout.Orig(p))
+		if err != nil {
+			return err
+		}
+
+		if err = os.Mkdir(p, origInfo.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to create overlay mount point %s: %v", p, err)
+		}
+	}
+
+	return device.OverlayRW(p, layout.OverlayDiff(p), layout.OverlayWorkdir(p), layout.Head(p))
+}
+
+func lexists(p string) (bool, error) {
+	if _, err := os.Lstat(p); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
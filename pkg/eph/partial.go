@@ -0,0 +1,267 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/ignore"
+	"github.com/gman0/eph/pkg/layout"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// mergeFilter selects the changes included in a partial merge.
+// A nil filter selects all of them.
+type mergeFilter struct {
+	// Selected paths relative to the ramdisk, with a leading slash.
+	// Empty if all paths are selected.
+	paths []string
+	// Glob patterns, matched against both relative paths and base names
+	exclude []string
+	// Ignored files are never merged
+	ignore *ignore.Matcher
+}
+
+func newMergeFilter(paths, exclude []string, ign *ignore.Matcher) (*mergeFilter, error) {
+	if len(paths) == 0 && len(exclude) == 0 && ign == nil {
+		return nil, nil
+	}
+
+	f := &mergeFilter{exclude: exclude, ignore: ign}
+
+	for _, p := range paths {
+		if path.IsAbs(p) {
+			return nil, fmt.Errorf("path %s must be relative to the ramdisk", p)
+		}
+
+		f.paths = append(f.paths, path.Clean("/"+p))
+	}
+
+	for _, pattern := range exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %s: %v", pattern, err)
+		}
+	}
+
+	return f, nil
+}
+
+// match reports whether relPath is selected, or whether it's an ancestor
+// of a selected path and its children need to be walked.
+func (f *mergeFilter) match(relPath string) (selected, isAncestor bool) {
+	if f == nil {
+		return true, false
+	}
+
+	if f.excluded(relPath) {
+		return false, false
+	}
+
+	if len(f.paths) == 0 {
+		return true, false
+	}
+
+	for _, p := range f.paths {
+		if relPath == p || strings.HasPrefix(relPath, p+"/") {
+			return true, false
+		}
+
+		if relPath == "" || strings.HasPrefix(p, relPath+"/") {
+			isAncestor = true
+		}
+	}
+
+	return false, isAncestor
+}
+
+// ignored reports whether change c is ignored, along with everything
+// inside of it
+func (f *mergeFilter) ignored(c *change) bool {
+	return f != nil && isIgnored(f.ignore, c)
+}
+
+func (f *mergeFilter) excluded(relPath string) bool {
+	if relPath == "" {
+		return false
+	}
+
+	for _, pattern := range f.exclude {
+		if ok, _ := path.Match(pattern, relPath[1:]); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, path.Base(relPath)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectsAll checks whether a selected directory can be merged as a whole,
+// i.e. none of its descendants is excluded or ignored.
+func (f *mergeFilter) selectsAll(relPath, source string) (bool, error) {
+	if f == nil || len(f.exclude) == 0 && f.ignore == nil {
+		return true, nil
+	}
+
+	iter, err := diriter.NewRecursiveIter(source)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+
+	for !iter.AtEnd() {
+		var (
+			p   = path.Join(iter.Base(), iter.FileInfo().Name())
+			rel = relPath + p[len(source):]
+		)
+
+		if f.excluded(rel) || f.ignore.Match(rel[1:], iter.FileInfo().IsDir()) {
+			return false, nil
+		}
+
+		if iter.Increment(); iter.Err() != nil {
+			return false, iter.Err()
+		}
+	}
+
+	return true, nil
+}
+
+// dropMergedChanges removes the changes written into orig by a partial
+// merge from the overlay's upper layer, so that they're no longer reported
+// as changes. Changes stored in snapshot layers are left as they are,
+// as well as upper layer dirents that hide an older snapshot version.
+func dropMergedChanges(p string, j *mergeJournal) error {
+	diff := layout.OverlayDiff(p)
+
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	layers, err := snapshotLayers(ss, p)
+	if err != nil {
+		return err
+	}
+
+	// Children are dropped before their parents
+	for i := len(j.Ops) - 1; i >= 0; i-- {
+		op := &j.Ops[i]
+
+		inSnapshot, err := existsInLayers(layers[:len(layers)-1], op.Path)
+		if err != nil {
+			return err
+		}
+
+		if inSnapshot {
+			continue
+		}
+
+		if err = dropMergedChange(diff, op); err != nil {
+			return fmt.Errorf("%s %s: %v", op.Kind, op.Path, err)
+		}
+	}
+
+	return nil
+}
+
+func existsInLayers(layers []string, relPath string) (bool, error) {
+	for _, layer := range layers {
+		if _, err := os.Lstat(layer + relPath); err == nil {
+			return true, nil
+		} else if !isNotExist(err) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+func dropMergedChange(diff string, op *mergeOp) error {
+	switch op.Kind {
+	case mergeDelete:
+		return dropWhiteout(diff + op.Path)
+	case mergeRename:
+		if err := dropWhiteout(diff + op.From); err != nil {
+			return err
+		}
+
+		if !op.Dir {
+			return dropMergedChange(diff, &mergeOp{Kind: mergeAdd, Path: op.Path, Source: op.Source})
+		}
+
+		if !strings.HasPrefix(op.Source, diff+"/") {
+			return nil
+		}
+
+		// The original version has been moved to Path in orig,
+		// the directory's contents are no longer elsewhere
+		if err := device.RemoveRedirectAttr(op.Source); err != nil && err != syscall.ENODATA {
+			return err
+		}
+
+		// Unmerged children are still there
+		if err := os.Remove(op.Source); err != nil && !os.IsNotExist(err) && !isNotEmpty(err) {
+			return err
+		}
+	case mergeAdd, mergeReplace:
+		if !strings.HasPrefix(op.Source, diff+"/") {
+			return nil
+		}
+
+		// Contents of an opaque directory hide orig, dropping
+		// the dirent would make it disappear from the ramdisk
+		if isOpaque, _ := device.IsOpaque(path.Dir(op.Source)); isOpaque {
+			return nil
+		}
+
+		if op.Shallow {
+			// Excluded children are still there
+			if err := os.Remove(op.Source); err != nil && !os.IsNotExist(err) && !isNotEmpty(err) {
+				return err
+			}
+			return nil
+		}
+
+		return os.RemoveAll(op.Source)
+	}
+
+	return nil
+}
+
+func dropWhiteout(p string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if device.IsWhiteout(info) {
+		return os.Remove(p)
+	}
+
+	return nil
+}
+
+// isNotExist also treats a non-directory in the path as a missing dirent
+func isNotExist(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOTDIR {
+		return true
+	}
+
+	return os.IsNotExist(err)
+}
+
+func isNotEmpty(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == syscall.ENOTEMPTY || pathErr.Err == syscall.EEXIST
+	}
+
+	return false
+}
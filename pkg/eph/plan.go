@@ -0,0 +1,328 @@
+package eph
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/output"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// mergePlan is a reviewable list of operations a merge would perform.
+type mergePlan struct {
+	Target  string    `json:"target"`
+	Created time.Time `json:"created"`
+	Ops     []mergeOp `json:"ops"`
+}
+
+func (mp *mergePlan) write(p string) error {
+	b, err := json.MarshalIndent(mp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, b, 0644)
+}
+
+func readMergePlan(p string) (*mergePlan, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	mp := &mergePlan{}
+
+	return mp, json.Unmarshal(b, mp)
+}
+
+func (mp *mergePlan) matches(ops []mergeOp) error {
+	return matchOps(mp.Ops, ops)
+}
+
+// matchOps checks whether ops are exactly the same as the planned ones.
+// Sizes and change times of the sources are compared as well,
+// so that any modification of the ramdisk is detected.
+func matchOps(planned, ops []mergeOp) error {
+	if len(planned) != len(ops) {
+		return fmt.Errorf("expected %d changes, found %d", len(planned), len(ops))
+	}
+
+	for i := range ops {
+		// Attributes are recorded only once the op is staged
+		p, op := planned[i], ops[i]
+		p.SourceAttrs, op.SourceAttrs = nil, nil
+
+		if p != op {
+			return fmt.Errorf("%s has changed", ops[i].Path)
+		}
+	}
+
+	return nil
+}
+
+// treeStat counts all dirents in a subtree, sums up their apparent sizes
+// and finds the most recent change time among them.
+func treeStat(p string) (files, bytes, changed int64, err error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	add := func(info os.FileInfo) {
+		files++
+
+		st := info.Sys().(*syscall.Stat_t)
+		if ctime := st.Ctim.Nano(); ctime > changed {
+			changed = ctime
+		}
+
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+		}
+	}
+
+	add(info)
+
+	if !info.IsDir() {
+		return
+	}
+
+	iter, err := diriter.NewRecursiveIter(p)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer iter.Close()
+
+	for !iter.AtEnd() {
+		add(iter.FileInfo())
+
+		if iter.Increment(); iter.Err() != nil {
+			return 0, 0, 0, iter.Err()
+		}
+	}
+
+	return
+}
+
+// setOpStats fills in the number of dirents and bytes the op copies
+// or deletes and the change time of its source
+func setOpStats(op *mergeOp, origPath string) error {
+	var err error
+
+	switch op.Kind {
+	case mergeAdd, mergeReplace:
+		if op.Shallow {
+			// The contents are covered by separate ops
+			var info os.FileInfo
+			if info, err = os.Lstat(op.Source); err == nil {
+				op.Files = 1
+				op.Changed = info.Sys().(*syscall.Stat_t).Ctim.Nano()
+			}
+			break
+		}
+
+		op.Files, op.Bytes, op.Changed, err = treeStat(op.Source)
+	case mergeDelete:
+		op.Files, op.Bytes, _, err = treeStat(origPath)
+	case mergeAttr, mergeRename:
+		var info os.FileInfo
+		if info, err = os.Lstat(op.Source); err == nil {
+			op.Changed = info.Sys().(*syscall.Stat_t).Ctim.Nano()
+		}
+	}
+
+	return err
+}
+
+func mergeOpStatusCode(op *mergeOp) changeStatusCode {
+	var status changeStatusCode
+
+	switch op.Kind {
+	case mergeAdd:
+		status = statusAdded
+	case mergeReplace:
+		status = statusModified
+		if op.Meta {
+			status = statusMetadata
+		}
+	case mergeAttr:
+		status = statusMetadata
+	case mergeDelete:
+		status = statusDeleted
+	case mergeRename:
+		status = statusRenamed
+	}
+
+	if op.Dir {
+		status ^= 0x20
+	}
+
+	return status
+}
+
+// mergeListing is what's printed in JSON output before merging,
+// or instead of it when only planning
+type mergeListing struct {
+	Conflicts []mergeConflict `json:"conflicts"`
+	Ops       []mergeEntry    `json:"ops"`
+	Summary   *mergeSummary   `json:"summary,omitempty"`
+}
+
+// mergeConflict is a path changed both in the ramdisk and in the source
+// directory, Keep is the conflict strategy that resolved it
+type mergeConflict struct {
+	Path string `json:"path"`
+	Keep string `json:"keep"`
+}
+
+type mergeEntry struct {
+	Code  string `json:"code"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Dir   bool   `json:"dir"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type mergeSummary struct {
+	Copy        int   `json:"copy"`
+	CopyBytes   int64 `json:"copy_bytes"`
+	Delete      int   `json:"delete"`
+	DeleteBytes int64 `json:"delete_bytes"`
+	Rename      int   `json:"rename"`
+}
+
+// printMergeOps lists the conflicts resolved with strategy, and the ops
+// about to be merged. When only planning, sizes of the ops and their
+// totals are listed as well.
+func printMergeOps(ops []mergeOp, conflicts []string, strategy string, planning bool) error {
+	switch output.Format {
+	case output.Porcelain:
+		w := output.NewWriter()
+
+		for _, c := range conflicts {
+			w.Record("C", output.Quote(c[1:]))
+		}
+
+		for i := range ops {
+			code := string(rune(mergeOpStatusCode(&ops[i])))
+			if ops[i].Kind == mergeRename {
+				w.Rename(code, ops[i].From[1:], ops[i].Path[1:])
+			} else {
+				w.Record(code, output.Quote(ops[i].Path[1:]))
+			}
+		}
+
+		return w.Flush()
+	case output.JSON:
+		l := mergeListing{
+			Conflicts: make([]mergeConflict, len(conflicts)),
+			Ops:       make([]mergeEntry, len(ops)),
+		}
+
+		for i, c := range conflicts {
+			l.Conflicts[i] = mergeConflict{Path: c[1:], Keep: strategy}
+		}
+
+		for i := range ops {
+			l.Ops[i] = mergeEntry{
+				Code:  string(rune(mergeOpStatusCode(&ops[i]))),
+				Path:  ops[i].Path[1:],
+				Dir:   ops[i].Dir,
+				Files: ops[i].Files,
+				Bytes: ops[i].Bytes,
+			}
+
+			if ops[i].Kind == mergeRename {
+				l.Ops[i].From = ops[i].From[1:]
+			}
+		}
+
+		if planning {
+			sum := summarizeMergeOps(ops)
+			l.Summary = &sum
+		}
+
+		return output.WriteJSON(l)
+	}
+
+	for _, c := range conflicts {
+		fmt.Printf("C %s (keeping %s)\n", c[1:], strategy)
+	}
+
+	for i := range ops {
+		p := ops[i].Path[1:]
+		if ops[i].Kind == mergeRename {
+			p = ops[i].From[1:] + " -> " + p
+		}
+
+		if planning && ops[i].Bytes > 0 {
+			fmt.Printf("%c %s (%s)\n", mergeOpStatusCode(&ops[i]), p, humanBytes(uint64(ops[i].Bytes)))
+		} else {
+			fmt.Printf("%c %s\n", mergeOpStatusCode(&ops[i]), p)
+		}
+	}
+
+	if planning {
+		sum := summarizeMergeOps(ops)
+
+		fmt.Printf("\n%d to copy (%s), %d to delete (%s)", sum.Copy, humanBytes(uint64(sum.CopyBytes)), sum.Delete, humanBytes(uint64(sum.DeleteBytes)))
+
+		if sum.Rename > 0 {
+			fmt.Printf(", %d to rename", sum.Rename)
+		}
+
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func summarizeMergeOps(ops []mergeOp) mergeSummary {
+	var sum mergeSummary
+
+	for i := range ops {
+		switch ops[i].Kind {
+		case mergeAdd, mergeReplace:
+			sum.Copy++
+			sum.CopyBytes += ops[i].Bytes
+		case mergeDelete:
+			sum.Delete++
+			sum.DeleteBytes += ops[i].Bytes
+		case mergeRename:
+			sum.Rename++
+		}
+	}
+
+	return sum
+}
+
+// planOnly lists the changes a merge would perform without touching
+// anything, optionally writing them into a plan file
+func planOnly(p string, planOps opsPlanner, opts MergeOptions) error {
+	ops, conflicts, err := planOps()
+	if err != nil {
+		return err
+	}
+
+	if err = printMergeOps(ops, conflicts, opts.Strategy, true); err != nil {
+		return err
+	}
+
+	if opts.PlanFile != "" {
+		mp := mergePlan{
+			Target:  p,
+			Created: time.Now(),
+			Ops:     ops,
+		}
+
+		if err = mp.write(opts.PlanFile); err != nil {
+			return fmt.Errorf("failed to write merge plan: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,352 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"github.com/gman0/eph/pkg/output"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Outcomes of recovering a ramdisk
+const (
+	recoverDone = "recovered"
+	// The ramdisk is mounted, there's nothing to recover
+	recoverMounted = "mounted"
+	// The registered eph root doesn't exist (anymore)
+	recoverMissing = "missing"
+	recoverFailed  = "failed"
+)
+
+// recoveredEph describes what has been done to recover a ramdisk
+type recoveredEph struct {
+	Target  string   `json:"target"`
+	EphRoot string   `json:"eph_root"`
+	Result  string   `json:"result"`
+	Actions []string `json:"actions"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type RecoverOptions struct {
+	// All recovers all ramdisks in the registry instead of a single one
+	All bool
+	// Boot recovers all ramdisks and prints only what has been done,
+	// meant to be run once the local filesystems are mounted at boot
+	Boot bool
+}
+
+// Recover puts the original data of ramdisk p back in place after its
+// tmpfs has been lost, e.g. to a reboot or a crash, or after Create failed
+// to roll back. Leftover mounts, mount points and symlinks are removed
+// along with the eph root. Merges that were interrupted are finished
+// if all of their data has already been written, aborted otherwise.
+// With opts.All or opts.Boot, p is ignored and all registered ramdisks
+// are recovered.
+func Recover(p string, opts RecoverOptions) error {
+	mounts, err := device.Mounts()
+	if err != nil {
+		return fmt.Errorf("failed to read mounts: %v", err)
+	}
+
+	if !opts.All && !opts.Boot {
+		base, err := filepath.Abs(layout.Base(p))
+		if err != nil {
+			return err
+		}
+
+		if isNotExist, err := layout.DirectoryShouldExist(base); err != nil {
+			if isNotExist {
+				return fmt.Errorf("eph root %s does not exist", base)
+			}
+			return err
+		}
+
+		r := recoverEph(base, p, mounts)
+
+		switch r.Result {
+		case recoverMounted:
+			return fmt.Errorf("ramdisk %s is mounted, there's nothing to recover", p)
+		case recoverFailed:
+			// The steps done before the failure are printed along with it
+			printRecovered([]recoveredEph{r}, opts)
+			return fmt.Errorf("failed to recover %s", p)
+		}
+
+		return printRecovered([]recoveredEph{r}, opts)
+	}
+
+	ephs, err := registeredEphs()
+	if err != nil {
+		return fmt.Errorf("failed to read eph root registry %s: %v", layout.Registry, err)
+	}
+
+	if ephs == nil {
+		ephs = make(map[string]string)
+	}
+
+	// Registering a ramdisk is best-effort, the ones still mounted
+	// are found without it
+	for base, target := range mountedEphs(mounts) {
+		if _, ok := ephs[base]; ok {
+			continue
+		}
+
+		if target == "" {
+			target = layout.TargetOf(base)
+		}
+
+		ephs[base] = target
+	}
+
+	bases := make([]string, 0, len(ephs))
+	for base := range ephs {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	var (
+		recovered = []recoveredEph{}
+		failed    int
+	)
+
+	for _, base := range bases {
+		r := recoverEph(base, ephs[base], mounts)
+		if r.Result == recoverFailed {
+			failed++
+		}
+
+		recovered = append(recovered, r)
+	}
+
+	if err = printRecovered(recovered, opts); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to recover %d of %d ramdisks", failed, len(recovered))
+	}
+
+	return nil
+}
+
+// recoverEph recovers the ramdisk at p with eph root base. mounts are
+// the filesystems mounted at the moment.
+func recoverEph(base, p string, mounts []device.Mount) recoveredEph {
+	r := recoveredEph{Target: p, EphRoot: base, Actions: []string{}}
+
+	if _, err := os.Lstat(base); err != nil {
+		r.Result = recoverMissing
+		if !os.IsNotExist(err) {
+			r.Result, r.Error = recoverFailed, err.Error()
+		}
+		return r
+	}
+
+	for _, m := range mounts {
+		if m.MountPoint == layout.StagingIn(base) && m.FsType == "tmpfs" {
+			r.Result = recoverMounted
+			return r
+		}
+	}
+
+	l, err := lockEphRoot(base, p, lock.Exclusive)
+	if err != nil {
+		r.Result, r.Error = recoverFailed, err.Error()
+		return r
+	}
+	defer l.Release()
+
+	did := func(format string, args ...interface{}) {
+		r.Actions = append(r.Actions, fmt.Sprintf(format, args...))
+	}
+
+	if err := recoverSteps(base, p, mounts, did); err != nil {
+		r.Result, r.Error = recoverFailed, err.Error()
+		return r
+	}
+
+	r.Result = recoverDone
+	return r
+}
+
+func recoverSteps(base, p string, mounts []device.Mount, did func(format string, args ...interface{})) error {
+	// Ramdisks created with --eph-root are recovered just the same,
+	// the layout paths are derived from their eph root
+	var (
+		orig        = layout.OrigIn(base)
+		staging     = layout.StagingIn(base)
+		journalPath = layout.MergeJournalIn(base)
+	)
+
+	// Mounts left behind by Create or by a failed merge: the overlay,
+	// HEAD and snapshots. Unmounted in reverse, topmost first.
+	for i := len(mounts) - 1; i >= 0; i-- {
+		m := mounts[i]
+
+		leftover := strings.HasPrefix(m.MountPoint, base+"/")
+		if b, ok := layout.BaseOfOverlayDiff(m.Options["upperdir"]); ok && b == base {
+			leftover = true
+		}
+
+		if !leftover {
+			continue
+		}
+
+		if err := device.Unmount(m.MountPoint); err != nil {
+			return fmt.Errorf("failed to unmount %s: %v", m.MountPoint, err)
+		}
+
+		did("unmounted %s", m.MountPoint)
+	}
+
+	j, err := readMergeJournal(journalPath)
+	if err == nil {
+		cmdName := j.Mode.cmdName()
+
+		// Only staging reads the data in the ramdisk, once it's done
+		// the new versions are all next to their targets
+		if j.Phase == mergePhaseStaging {
+			if err = j.abort(); err != nil {
+				return fmt.Errorf("failed to abort interrupted %s: %v", cmdName, err)
+			}
+
+			did("aborted interrupted %s, its changes were lost along with the ramdisk", cmdName)
+		} else {
+			if err = j.run(journalPath, ""); err != nil {
+				return fmt.Errorf("failed to finish interrupted %s: %v", cmdName, err)
+			}
+
+			did("finished interrupted %s into %s", cmdName, j.Dest)
+		}
+
+		if err = os.Remove(journalPath); err != nil {
+			return fmt.Errorf("failed to remove merge journal %s: %v", journalPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read merge journal %s: %v", journalPath, err)
+	}
+
+	origInfo, err := os.Lstat(orig)
+
+	switch {
+	case os.IsNotExist(err):
+		// Create failed before moving the original data
+	case err != nil:
+		return err
+	case origInfo.Mode()&os.ModeSymlink != 0:
+		// The source directory of a --target ramdisk was never moved
+		if err = os.Remove(orig); err != nil {
+			return fmt.Errorf("failed to remove orig symlink %s: %v", orig, err)
+		}
+
+		did("removed symlink %s", orig)
+
+		if removed, err := removeMountPoint(p); err != nil {
+			return err
+		} else if removed {
+			did("removed mount point %s", p)
+		}
+	default:
+		if _, err = removeMountPoint(p); err != nil {
+			return fmt.Errorf("%v, the original data is kept in %s", err, orig)
+		}
+
+		if err = os.Rename(orig, p); err != nil {
+			return fmt.Errorf("failed to restore orig %s: %v", orig, err)
+		}
+
+		did("restored original data from %s to %s", orig, p)
+	}
+
+	if _, err = os.Lstat(staging); err == nil {
+		// Holds only the empty mount points of what's been in the ramdisk
+		if err = os.RemoveAll(staging); err != nil {
+			return fmt.Errorf("failed to remove ramdisk mount point %s: %v", staging, err)
+		}
+
+		did("removed ramdisk mount point %s", staging)
+	}
+
+	if err = os.Remove(layout.SourceManifestIn(base)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove source manifest: %v", err)
+	}
+
+	if err = removeLock(base); err != nil {
+		return err
+	}
+
+	if err = os.Remove(base); err != nil {
+		return fmt.Errorf("failed to remove eph root %s: %v", base, err)
+	}
+
+	did("removed eph root %s", base)
+
+	if err = unregisterEph(base); err != nil {
+		return fmt.Errorf("failed to unregister eph root %s: %v", base, err)
+	}
+
+	return nil
+}
+
+// removeMountPoint removes the empty directory the overlay was mounted on.
+// false is returned if there's none.
+func removeMountPoint(p string) (bool, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !info.IsDir() {
+		return false, fmt.Errorf("mount point %s is not a directory", p)
+	}
+
+	if err = os.Remove(p); err != nil {
+		if os.IsExist(err) {
+			return false, fmt.Errorf("mount point %s is not empty", p)
+		}
+		return false, fmt.Errorf("failed to remove mount point %s: %v", p, err)
+	}
+
+	return true, nil
+}
+
+func printRecovered(recovered []recoveredEph, opts RecoverOptions) error {
+	switch output.Format {
+	case output.JSON:
+		return output.WriteJSON(recovered)
+	case output.Porcelain:
+		w := output.NewWriter()
+
+		for _, r := range recovered {
+			w.Record(r.Result, output.Quote(r.Target))
+		}
+
+		return w.Flush()
+	}
+
+	for _, r := range recovered {
+		for _, action := range r.Actions {
+			fmt.Printf("%s: %s\n", r.Target, action)
+		}
+
+		switch r.Result {
+		case recoverMounted:
+			if !opts.Boot {
+				fmt.Printf("%s: ramdisk is mounted, nothing to recover\n", r.Target)
+			}
+		case recoverMissing:
+			fmt.Fprintf(os.Stderr, "%s: eph root %s not found, skipped\n", r.Target, r.EphRoot)
+		case recoverFailed:
+			fmt.Fprintf(os.Stderr, "%s: %s\n", r.Target, r.Error)
+		}
+	}
+
+	return nil
+}
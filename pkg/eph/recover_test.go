@@ -0,0 +1,131 @@
+package eph
+
+import (
+	"github.com/gman0/eph/pkg/layout"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func checkMode(t *testing.T, p string, mode os.FileMode) os.FileInfo {
+	t.Helper()
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != mode {
+		t.Errorf("%s: mode %v, expected %v", p, info.Mode().Perm(), mode)
+	}
+
+	return info
+}
+
+// A merge interrupted by a reboot once all of its changes have been staged
+// is finished by recover, even though the ramdisk holding them is gone
+func TestRecoverFinishesMergeWithoutRamdisk(t *testing.T) {
+	var (
+		tmp   = tempDir(t)
+		p     = path.Join(tmp, "target")
+		base  = layout.Base(p)
+		orig  = layout.Orig(p)
+		upper = path.Join(tmp, "upper")
+		mtime = time.Unix(1500000000, 123456789)
+	)
+
+	// The target location is left as an empty mount point
+	mustMkdir(t, p, 0755)
+	mustMkdir(t, base, 0755)
+	mustMkdir(t, orig, 0755)
+	mustMkdir(t, path.Join(orig, "attr"), 0755)
+	mustMkdir(t, path.Join(orig, "old"), 0755)
+	mustWriteFile(t, path.Join(orig, "old", "f"), "renamed")
+
+	// Stands in for the ramdisk's upper layer
+	mustMkdir(t, upper, 0755)
+	mustMkdir(t, path.Join(upper, "attr"), 0700)
+	mustMkdir(t, path.Join(upper, "new"), 0750)
+	mustMkdir(t, path.Join(upper, "shallow"), 0711)
+	mustWriteFile(t, path.Join(upper, "shallow", "f"), "added")
+
+	hasXattr := unix.Lsetxattr(path.Join(upper, "attr"), "user.eph-test", []byte("x"), 0) == nil
+
+	for _, dir := range []string{"attr", "new", "shallow"} {
+		if err := os.Chtimes(path.Join(upper, dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j := &mergeJournal{
+		Phase: mergePhaseStaging,
+		Mode:  mergeModeMerge,
+		Dest:  orig,
+		Ops: []mergeOp{
+			{Kind: mergeAttr, Path: "attr", Source: path.Join(upper, "attr"), Dir: true, Mode: os.ModeDir | 0755},
+			{Kind: mergeRename, Path: "new", From: "old", Source: path.Join(upper, "new"), Dir: true, Mode: os.ModeDir | 0755},
+			{Kind: mergeAdd, Path: "shallow", Source: path.Join(upper, "shallow"), Dir: true, Shallow: true},
+			{Kind: mergeAdd, Path: "shallow/f", Source: path.Join(upper, "shallow", "f"), Nested: true},
+		},
+	}
+
+	journalPath := layout.MergeJournal(p)
+
+	if err := j.write(journalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.run(journalPath, mergePhaseCommit); err != nil {
+		t.Fatalf("staging failed: %v", err)
+	}
+
+	// Lost along with the ramdisk
+	if err := os.RemoveAll(upper); err != nil {
+		t.Fatal(err)
+	}
+
+	r := recoverEph(base, p, nil)
+	if r.Result != recoverDone {
+		t.Fatalf("recover %s: %s, actions: %v", r.Result, r.Error, r.Actions)
+	}
+
+	if _, err := os.Lstat(base); !os.IsNotExist(err) {
+		t.Errorf("eph root %s hasn't been removed: %v", base, err)
+	}
+
+	for _, dir := range []string{"attr", "new", "shallow"} {
+		info, err := os.Lstat(path.Join(p, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, expected %v", dir, info.ModTime(), mtime)
+		}
+	}
+
+	checkMode(t, path.Join(p, "attr"), 0700)
+	checkMode(t, path.Join(p, "new"), 0750)
+	checkMode(t, path.Join(p, "shallow"), 0711)
+
+	if hasXattr {
+		if val, err := unix.Lgetxattr(path.Join(p, "attr"), "user.eph-test", make([]byte, 16)); err != nil || val != 1 {
+			t.Errorf("attr: xattr user.eph-test hasn't been merged: %v", err)
+		}
+	}
+
+	if b, err := ioutil.ReadFile(path.Join(p, "new", "f")); err != nil || string(b) != "renamed" {
+		t.Errorf("new/f: %q, %v", b, err)
+	}
+
+	if _, err := os.Lstat(path.Join(p, "old")); !os.IsNotExist(err) {
+		t.Errorf("old hasn't been renamed: %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(path.Join(p, "shallow", "f")); err != nil || string(b) != "added" {
+		t.Errorf("shallow/f: %q, %v", b, err)
+	}
+}
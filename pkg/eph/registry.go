@@ -0,0 +1,80 @@
+package eph
+
+import (
+	"github.com/gman0/eph/pkg/layout"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// registerEph records the eph root of ramdisk p in the registry,
+// see layout.Registry
+func registerEph(p string) error {
+	target, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+
+	base, err := filepath.Abs(layout.Base(p))
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(layout.Registry, 0755); err != nil {
+		return err
+	}
+
+	entry := layout.RegistryEntry(base)
+
+	// Left behind by a ramdisk that's gone by now
+	if err = os.Remove(entry); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Symlink(target, entry)
+}
+
+// unregisterEph removes eph root base from the registry
+func unregisterEph(base string) error {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(layout.RegistryEntry(base)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// registeredEphs lists the target locations of the registered
+// ramdisks by their eph roots
+func registeredEphs() (map[string]string, error) {
+	infos, err := ioutil.ReadDir(layout.Registry)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ephs := make(map[string]string, len(infos))
+
+	for _, info := range infos {
+		base, err := layout.BaseOfRegistryEntry(info.Name())
+		if err != nil {
+			continue
+		}
+
+		target, err := os.Readlink(path.Join(layout.Registry, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		ephs[base] = target
+	}
+
+	return ephs, nil
+}
@@ -0,0 +1,306 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/device"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strings"
+)
+
+// renameDetector pairs deleted files with added ones that have the same
+// contents, so that they can be moved in orig instead of being copied
+// anew. Files that have been renamed in the overlay are copied up along
+// with the file handle of their original version, those are compared
+// first. Others are paired by their size and hash.
+type renameDetector struct {
+	orig    string
+	deleted []*change
+	added   []*change
+	// Original paths of renamed directories
+	dirs []string
+	// Added and replaced directories, files may have been moved into them
+	wholeDirs []*change
+}
+
+// renames maps the paths of renamed files to the deleted files they've
+// been renamed from. Those, and the original paths of renamed directories,
+// are no longer reported as deleted.
+type renames struct {
+	from map[string]*change
+	gone map[string]bool
+	// hidden lists the renamed files inside added and replaced directories
+	// that haven't been walked, by the directory's path
+	hidden map[string][]string
+}
+
+// expandDirs lists the directories that need to be walked
+// to find the hidden renamed files
+func (r *renames) expandDirs() map[string]bool {
+	dirs := make(map[string]bool)
+
+	for dir, files := range r.hidden {
+		for _, f := range files {
+			for p := path.Dir(f); p != dir; p = path.Dir(p) {
+				dirs[p] = true
+			}
+		}
+
+		dirs[dir] = true
+	}
+
+	return dirs
+}
+
+func (r *renames) isGone(relPath string) bool {
+	return r != nil && r.gone[relPath]
+}
+
+// add records a change that may turn out to be a part of a rename
+func (rd *renameDetector) add(c *change) {
+	switch {
+	case c.status == statusRenamed:
+		rd.dirs = append(rd.dirs, c.origPath)
+	case c.status == statusDeleted && c.origInfo.Mode().IsRegular() && c.origInfo.Size() > 0:
+		rd.deleted = append(rd.deleted, c)
+	case c.status == statusAdded && c.info.Mode().IsRegular() && c.info.Size() > 0:
+		// Empty files are all the same, they are not considered renamed
+		rd.added = append(rd.added, c)
+	case c.info.IsDir() && c.isWhole():
+		rd.wholeDirs = append(rd.wholeDirs, c)
+	}
+}
+
+func (rd *renameDetector) detect() (*renames, error) {
+	r := &renames{
+		from:   make(map[string]*change),
+		gone:   make(map[string]bool),
+		hidden: make(map[string][]string),
+	}
+
+	for _, p := range rd.dirs {
+		// Parents of renamed directories are left in place, the whiteout
+		// hiding the original version is at the same path
+		r.gone[p] = true
+	}
+
+	if len(rd.deleted) == 0 {
+		return r, nil
+	}
+
+	var (
+		byHandle map[string]*change
+		bySize   = make(map[int64][]*change)
+		hashes   = make(map[*change]string)
+		taken    = make(map[*change]bool)
+		// Directories the files found by scanning are in
+		scanned = make(map[*change]string)
+	)
+
+	for _, d := range rd.deleted {
+		bySize[d.origInfo.Size()] = append(bySize[d.origInfo.Size()], d)
+	}
+
+	for _, dir := range rd.wholeDirs {
+		if dir.descend() {
+			// The files have been walked already
+			continue
+		}
+
+		n := len(rd.added)
+		if err := rd.scan(dir.layer, dir.relPath, dir.source, bySize); err != nil {
+			return nil, err
+		}
+
+		for _, a := range rd.added[n:] {
+			scanned[a] = dir.relPath
+		}
+	}
+
+	for _, a := range rd.added {
+		handleType, handle, ok, err := device.Origin(a.source)
+		if err != nil {
+			return nil, err
+		}
+
+		var match *change
+
+		if ok {
+			if byHandle == nil {
+				if byHandle, err = rd.handles(); err != nil {
+					return nil, err
+				}
+			}
+
+			d := byHandle[handleKey(handleType, handle)]
+			if d != nil && !taken[d] && d.origInfo.Size() == a.info.Size() {
+				// It may have been modified after being renamed
+				same, err := sameFileContents(a.source, rd.orig+d.origPath)
+				if err != nil {
+					return nil, err
+				}
+
+				if same {
+					match = d
+				}
+			}
+		}
+
+		if match == nil {
+			if match, err = rd.matchContents(a, bySize[a.info.Size()], hashes, taken); err != nil {
+				return nil, err
+			}
+		}
+
+		if match != nil {
+			taken[match] = true
+			r.from[a.relPath] = match
+			r.gone[match.relPath] = true
+
+			if dir, ok := scanned[a]; ok {
+				r.hidden[dir] = append(r.hidden[dir], a.relPath)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// scan finds the files in an added directory that haven't been walked,
+// which have the same size as any of the deleted files
+func (rd *renameDetector) scan(layer, relPath, source string, bySize map[int64][]*change) error {
+	names, err := readOrigDirNames(source)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		p := source + "/" + name
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			err = rd.scan(layer, relPath+"/"+name, p, bySize)
+		case info.Mode().IsRegular() && len(bySize[info.Size()]) > 0:
+			rd.added = append(rd.added, &change{
+				layer:    layer,
+				relPath:  relPath + "/" + name,
+				origPath: relPath + "/" + name,
+				source:   p,
+				info:     info,
+				status:   statusAdded,
+			})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handles indexes the deleted files by their file handles in orig
+func (rd *renameDetector) handles() (map[string]*change, error) {
+	byHandle := make(map[string]*change, len(rd.deleted))
+
+	for _, d := range rd.deleted {
+		handleType, handle, err := device.FileHandle(rd.orig + d.origPath)
+		if err != nil {
+			if err == unix.EOPNOTSUPP {
+				// orig's filesystem doesn't support file handles
+				return byHandle, nil
+			}
+			return nil, err
+		}
+
+		byHandle[handleKey(handleType, handle)] = d
+	}
+
+	return byHandle, nil
+}
+
+func handleKey(handleType int32, handle []byte) string {
+	return fmt.Sprintf("%d:%x", handleType, handle)
+}
+
+// matchContents finds a deleted file among candidates of the same size
+// whose contents are the same as those of a. Hashes of the deleted files
+// are cached in hashes.
+func (rd *renameDetector) matchContents(a *change, candidates []*change, hashes map[*change]string, taken map[*change]bool) (*change, error) {
+	var aHash string
+
+	for _, d := range candidates {
+		if taken[d] {
+			continue
+		}
+
+		var err error
+
+		if aHash == "" {
+			if aHash, err = hashFile(a.source); err != nil {
+				return nil, err
+			}
+		}
+
+		dHash, ok := hashes[d]
+		if !ok {
+			if dHash, err = hashFile(rd.orig + d.origPath); err != nil {
+				return nil, err
+			}
+			hashes[d] = dHash
+		}
+
+		if aHash == dHash {
+			return d, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// origLocation finds where relPath is in the merge destination before
+// any of the renames among ops are merged: contents of renamed
+// directories are still at their original paths
+func origLocation(ops []mergeOp, renamedDirs []int, relPath string) string {
+	for {
+		i := renamedAncestor(ops, renamedDirs, relPath)
+		if i < 0 {
+			return relPath
+		}
+
+		relPath = ops[i].From + relPath[len(ops[i].Path):]
+	}
+}
+
+// renamedDirOps lists the indices of ops renaming directories
+func renamedDirOps(ops []mergeOp) []int {
+	var idxs []int
+
+	for i := range ops {
+		if ops[i].Kind == mergeRename && ops[i].Dir {
+			idxs = append(idxs, i)
+		}
+	}
+
+	return idxs
+}
+
+// renamedAncestor finds the closest of the renamed directories relPath
+// is in, -1 is returned if there's none
+func renamedAncestor(ops []mergeOp, renamedDirs []int, relPath string) int {
+	found := -1
+
+	for _, i := range renamedDirs {
+		if strings.HasPrefix(relPath, ops[i].Path+"/") && (found < 0 || len(ops[i].Path) > len(ops[found].Path)) {
+			found = i
+		}
+	}
+
+	return found
+}
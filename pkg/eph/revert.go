@@ -0,0 +1,225 @@
+package eph
+
+import (
+	"fmt"
+	"github.com/gman0/eph/pkg/beneath"
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"os"
+	"path"
+	"strings"
+)
+
+// Revert throws away the changes made to paths in ramdisk p, relative to it,
+// by removing them along with their whiteouts and opaque markers from the
+// overlay's upper layer. The paths are brought back to their state in orig,
+// or in the applied snapshot, as changes stored in snapshots are kept.
+// Directories renamed with redirect_dir are reverted along with the whiteouts
+// left at their old paths. Paths are resolved beneath the upper layer without
+// following symlinks, which the ramdisk's users are free to create there.
+// OverlayFS doesn't allow its layers to be modified while it's mounted,
+// so the overlay is briefly remounted, which invalidates all inodes in p.
+func Revert(p string, paths []string) error {
+	var (
+		base        = layout.Base(p)
+		diff        = layout.OverlayDiff(p)
+		journalPath = layout.MergeJournal(p)
+	)
+
+	if err := checkTargetAndBaseDirs(p, base); err != nil {
+		return err
+	}
+
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	if _, err := layout.PathShouldNotExist(journalPath); err != nil {
+		return fmt.Errorf("a merge is in progress, use --resume or --abort to finish it: %v", err)
+	}
+
+	if len(paths) == 0 {
+		return fmt.Errorf("no paths to revert")
+	}
+
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	layers, err := snapshotLayers(ss, p)
+	if err != nil {
+		return err
+	}
+
+	root, err := beneath.Open(diff)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	var relPaths []string
+
+	for _, rel := range paths {
+		if path.IsAbs(rel) {
+			return fmt.Errorf("path %s must be relative to the ramdisk", rel)
+		}
+
+		relPath := path.Clean("/" + rel)
+
+		if relPath == "/" {
+			return fmt.Errorf("can't revert the whole ramdisk, apply snapshot %d instead", ss.AppliedSnapshot)
+		}
+
+		renamedFrom, err := checkRevertable(root, layers[:len(layers)-1], relPath)
+		if err != nil {
+			return err
+		}
+
+		relPaths = append(relPaths, relPath)
+		if renamedFrom != "" {
+			relPaths = append(relPaths, renamedFrom)
+		}
+	}
+
+	if err = device.Unmount(p); err != nil {
+		return fmt.Errorf("failed to unmount overlay %s: %v", p, err)
+	}
+
+	// The paths are resolved again, they may have changed since they were checked
+	for _, relPath := range relPaths {
+		if err = removeBeneath(root, relPath); err != nil {
+			err = fmt.Errorf("failed to revert %s: %v", relPath[1:], err)
+			break
+		}
+	}
+
+	if mountErr := mountOverlay(p); mountErr != nil {
+		if err != nil {
+			return fmt.Errorf("%v\n  failed to remount overlay: %v", err, mountErr)
+		}
+		return fmt.Errorf("failed to remount overlay: %v", mountErr)
+	}
+
+	return err
+}
+
+// checkRevertable makes sure relPath has been changed in the upper layer
+// at root, and that it's not inside a directory replacing orig's version
+// as a whole or renamed from elsewhere: removing it from there wouldn't
+// bring the original back. If relPath is a renamed directory, the path
+// of the whiteout left where it was renamed from is returned.
+func checkRevertable(root *beneath.Root, snapLayers []string, relPath string) (string, error) {
+	info, err := lstatBeneath(root, relPath)
+	if err != nil {
+		if !isNotExist(err) {
+			return "", err
+		}
+
+		inSnapshot, err := existsInLayers(snapLayers, relPath)
+		if err != nil {
+			return "", err
+		}
+
+		if inSnapshot {
+			return "", fmt.Errorf("%s has been changed only in snapshots, apply an older snapshot to revert it", relPath[1:])
+		}
+
+		return "", fmt.Errorf("%s has no changes to revert", relPath[1:])
+	}
+
+	for dir := path.Dir(relPath); dir != "/"; dir = path.Dir(dir) {
+		isOpaque, from, err := dirMarkers(root, dir)
+		if err != nil {
+			return "", err
+		}
+
+		if isOpaque {
+			return "", fmt.Errorf("%s is inside %s, which replaces the original directory as a whole, revert %s instead", relPath[1:], dir[1:], dir[1:])
+		}
+
+		if from != "" {
+			return "", fmt.Errorf("%s is inside %s, which has been renamed from %s, revert %s instead", relPath[1:], dir[1:], from[1:], dir[1:])
+		}
+	}
+
+	if !info.IsDir() {
+		return "", nil
+	}
+
+	_, from, err := dirMarkers(root, relPath)
+	if err != nil || from == "" {
+		return "", err
+	}
+
+	// The original directory stays hidden until the whiteout is gone
+	fromInfo, err := lstatBeneath(root, from)
+	if err != nil && !isNotExist(err) {
+		return "", err
+	}
+
+	if err != nil || !device.IsWhiteout(fromInfo) {
+		return "", fmt.Errorf("%s has been renamed from %s, which has been changed since, revert both of them", relPath[1:], from[1:])
+	}
+
+	return from, nil
+}
+
+// dirMarkers checks whether directory relPath in the upper layer at root
+// is opaque, and where it's been renamed from, relative to root
+func dirMarkers(root *beneath.Root, relPath string) (bool, string, error) {
+	parent, err := root.OpenDir(path.Dir(relPath))
+	if err != nil {
+		return false, "", err
+	}
+	defer parent.Close()
+
+	p := path.Join(beneath.FdPath(parent), path.Base(relPath))
+
+	isOpaque, err := device.IsOpaque(p)
+	if err != nil {
+		return false, "", err
+	}
+
+	r, err := device.Redirect(p)
+	if err != nil || r == "" {
+		return isOpaque, "", err
+	}
+
+	// Either absolute or a name in the same parent
+	if !strings.HasPrefix(r, "/") {
+		r = path.Join(path.Dir(relPath), r)
+	}
+
+	return isOpaque, path.Clean(r), nil
+}
+
+// lstatBeneath is os.Lstat of relPath resolved beneath root
+func lstatBeneath(root *beneath.Root, relPath string) (os.FileInfo, error) {
+	parent, err := root.OpenDir(path.Dir(relPath))
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+
+	return os.Lstat(path.Join(beneath.FdPath(parent), path.Base(relPath)))
+}
+
+// removeBeneath removes relPath resolved beneath root along with its contents,
+// none of the symlinks in there are followed. Nothing is done if it's gone.
+func removeBeneath(root *beneath.Root, relPath string) error {
+	parent, err := root.OpenDir(path.Dir(relPath))
+	if err != nil {
+		if isNotExist(err) {
+			// Removed along with one of its parents
+			return nil
+		}
+		return err
+	}
+	defer parent.Close()
+
+	return os.RemoveAll(path.Join(beneath.FdPath(parent), path.Base(relPath)))
+}
@@ -0,0 +1,85 @@
+package eph
+
+import (
+	"github.com/gman0/eph/pkg/beneath"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckRevertable(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("whiteouts and trusted xattrs need root")
+	}
+
+	var (
+		tmp     = tempDir(t)
+		diff    = path.Join(tmp, "diff")
+		outside = path.Join(tmp, "outside")
+	)
+
+	mustMkdir(t, diff, 0755)
+	mustMkdir(t, outside, 0755)
+	mustWriteFile(t, path.Join(outside, "passwd"), "passwd")
+
+	// diff:
+	//   evil      symlink pointing outside
+	//   opq/f     inside an opaque directory
+	//   renamed/f renamed from old, which is a whiteout
+	//   moved     renamed from changed, which is a directory again
+	if err := os.Symlink(outside, path.Join(diff, "evil")); err != nil {
+		t.Fatal(err)
+	}
+
+	mustMkdir(t, path.Join(diff, "opq"), 0755)
+	mustSetXattr(t, path.Join(diff, "opq"), "trusted.overlay.opaque", "y")
+	mustWriteFile(t, path.Join(diff, "opq", "f"), "f")
+
+	mustMkdir(t, path.Join(diff, "renamed"), 0755)
+	mustSetXattr(t, path.Join(diff, "renamed"), "trusted.overlay.redirect", "old")
+	mustWriteFile(t, path.Join(diff, "renamed", "f"), "f")
+	mustWhiteout(t, path.Join(diff, "old"))
+
+	mustMkdir(t, path.Join(diff, "moved"), 0755)
+	mustSetXattr(t, path.Join(diff, "moved"), "trusted.overlay.redirect", "/changed")
+	mustMkdir(t, path.Join(diff, "changed"), 0755)
+
+	root, err := beneath.Open(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	for _, relPath := range []string{"/evil/passwd", "/opq/f", "/renamed/f", "/moved", "/nothing"} {
+		if _, err = checkRevertable(root, nil, relPath); err == nil {
+			t.Errorf("%s: expected an error", relPath)
+		}
+	}
+
+	if err = removeBeneath(root, "/evil/passwd"); err == nil {
+		t.Error("/evil/passwd: removed through a symlink")
+	}
+
+	if _, err = os.Lstat(path.Join(outside, "passwd")); err != nil {
+		t.Errorf("file outside of diff: %v", err)
+	}
+
+	renamedFrom, err := checkRevertable(root, nil, "/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renamedFrom != "/old" {
+		t.Errorf("/renamed: renamed from %q, expected /old", renamedFrom)
+	}
+
+	for _, relPath := range []string{"/renamed", renamedFrom} {
+		if err = removeBeneath(root, relPath); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = os.Lstat(path.Join(diff, relPath)); !os.IsNotExist(err) {
+			t.Errorf("%s: not removed", relPath)
+		}
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"github.com/gman0/eph/pkg/device"
 	"github.com/gman0/eph/pkg/diriter"
 	"github.com/gman0/eph/pkg/layout"
+	"github.com/gman0/eph/pkg/lock"
+	"github.com/gman0/eph/pkg/output"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -23,32 +26,112 @@ type Snapshot struct {
 }
 
 type SnapshotsState struct {
+	// Version of the format, 0 for states written before it's been
+	// versioned. See snapshotsStateMigrations.
+	Version         int              `json:"version"`
 	Counter         int              `json:"counter"`
 	Snapshots       map[int]Snapshot `json:"snapshots"`
 	AppliedSnapshot int              `json:"applied_snapshot,omitempty"`
 }
 
+// snapshotsStateMigrations bring snapshots states written by older versions
+// of eph up to date, each of them upgrades the state from the version given
+// by its index to the next one. Changing the format, e.g. adding new fields,
+// needs a migration filling them in for the existing eph roots.
+var snapshotsStateMigrations = []func(ss *SnapshotsState) error{
+	// 0 -> 1: the version has been added
+	func(ss *SnapshotsState) error { return nil },
+}
+
+// snapshotsStateVersion is the version of the format written by this eph
+var snapshotsStateVersion = len(snapshotsStateMigrations)
+
+// snapshotsStateBackup is the previous generation of the snapshots state at p
+func snapshotsStateBackup(p string) string { return p + ".prev" }
+
+// write replaces the snapshots state at p atomically, so that it's left
+// as it was should the write fail, e.g. when the ramdisk is full. The state
+// it replaces is kept as a backup.
 func (ss SnapshotsState) write(p string) error {
-	if ss, err := json.Marshal(ss); err != nil {
+	ss.Version = snapshotsStateVersion
+
+	b, err := json.Marshal(ss)
+	if err != nil {
 		return err
-	} else {
-		if err = ioutil.WriteFile(p, ss, 0600); err != nil {
-			return fmt.Errorf("failed to write snapshot state: %v", err)
+	}
+
+	// A corrupt state would replace a good backup
+	if _, err = readSnapshotsStateFile(p); err == nil {
+		backup := snapshotsStateBackup(p)
+
+		if err = os.Remove(backup); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove snapshots state backup: %v", err)
+		}
+
+		if err = os.Link(p, backup); err != nil {
+			return fmt.Errorf("failed to back up snapshots state: %v", err)
 		}
 	}
 
+	if err = writeFileAtomic(p, b, 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot state: %v", err)
+	}
+
 	return nil
 }
 
-func readSnapshotsState(stateFilePath string) (*SnapshotsState, error) {
-	b, err := ioutil.ReadFile(stateFilePath)
+// readSnapshotsState reads the snapshots state at p and migrates it to the
+// current version. If the state is corrupt, its backup is read instead.
+func readSnapshotsState(p string) (*SnapshotsState, error) {
+	ss, err := readSnapshotsStateFile(p)
+	if err == nil || !isCorruptJSON(err) {
+		return ss, err
+	}
+
+	backup := snapshotsStateBackup(p)
+
+	ss, backupErr := readSnapshotsStateFile(backup)
+	if backupErr != nil {
+		return nil, fmt.Errorf("%v, and its backup %s can't be read either: %v", err, backup, backupErr)
+	}
+
+	fmt.Fprintf(os.Stderr, "snapshots state %s is corrupt (%v), using its backup %s instead\n", p, err, backup)
+
+	return ss, nil
+}
+
+func readSnapshotsStateFile(p string) (*SnapshotsState, error) {
+	b, err := ioutil.ReadFile(p)
 	if err != nil {
 		return nil, err
 	}
 
 	ss := &SnapshotsState{}
 
-	return ss, json.Unmarshal(b, ss)
+	if err = json.Unmarshal(b, ss); err != nil {
+		return nil, err
+	}
+
+	if ss.Version > snapshotsStateVersion {
+		return nil, fmt.Errorf("snapshots state version %d is newer than %d supported by this eph, please upgrade", ss.Version, snapshotsStateVersion)
+	}
+
+	for ; ss.Version < snapshotsStateVersion; ss.Version++ {
+		if err = snapshotsStateMigrations[ss.Version](ss); err != nil {
+			return nil, fmt.Errorf("failed to migrate snapshots state from version %d: %v", ss.Version, err)
+		}
+	}
+
+	return ss, nil
+}
+
+func isCorruptJSON(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+
+	return false
 }
 
 func NewSnapshot(p, label, comprAlg string, remount bool) (int, error) {
@@ -56,6 +139,12 @@ func NewSnapshot(p, label, comprAlg string, remount bool) (int, error) {
 		return 0, err
 	}
 
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Release()
+
 	var (
 		diff               = layout.OverlayDiff(p)
 		snapshotsDir       = layout.Snapshots(p)
@@ -76,8 +165,28 @@ func NewSnapshot(p, label, comprAlg string, remount bool) (int, error) {
 		Created: time.Now(),
 	}
 
+	layers, err := snapshotLayers(ss, p)
+	if err != nil {
+		return 0, err
+	}
+
+	ign, err := loadIgnore(layers, layout.Orig(p))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read ignore rules: %v", err)
+	}
+
+	// Ignored files are left out of the snapshot
+	excludeFile, err := writeSnapshotExcludes(diff, ign)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list ignored files: %v", err)
+	}
+
+	if excludeFile != "" {
+		defer os.Remove(excludeFile)
+	}
+
 	snapPath := path.Join(snapshotsDir, layout.SnapshotFilename(snap.Id))
-	if err := device.Squash(diff, snapPath, comprAlg); err != nil {
+	if err := device.Squash(diff, snapPath, comprAlg, excludeFile); err != nil {
 		return 0, fmt.Errorf("failed to create snapshot: %v", err)
 	}
 
@@ -100,6 +209,12 @@ func DeleteSnapshot(p string, snapId int) error {
 		return err
 	}
 
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
 	ss, err := readSnapshotsState(layout.SnapshotsState(p))
 	if err != nil {
 		return fmt.Errorf("failed to read snapshots state: %v", err)
@@ -153,15 +268,13 @@ func ApplySnapshot(p string, snapId int) error {
 		return err
 	}
 
-	var (
-		head               = layout.Head(p)
-		diff               = layout.OverlayDiff(p)
-		snapshotsStatePath = layout.SnapshotsState(p)
-		snapshotsPath      = layout.Snapshots(p)
-		snapshotMountsPath = layout.SnapshotMounts(p)
-	)
+	l, err := lockEph(p, lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
 
-	ss, err := readSnapshotsState(snapshotsStatePath)
+	ss, err := readSnapshotsState(layout.SnapshotsState(p))
 	if err != nil {
 		return fmt.Errorf("failed to read snapshots state: %v", err)
 	}
@@ -180,7 +293,34 @@ func ApplySnapshot(p string, snapId int) error {
 		return fmt.Errorf("failed to unmount overlay %s: %v", p, err)
 	}
 
-	if err = device.Unmount(head); err != nil {
+	return resetOverlay(p, ss, snapId)
+}
+
+// resetOverlay discards all data stored in the ramdisk's upper layer
+// and mounts the overlay back on top of snapshot snapId. Ignored files
+// are kept, they aren't part of snapshots nor merged into orig.
+// The overlay itself is expected to be unmounted already.
+func resetOverlay(p string, ss *SnapshotsState, snapId int) error {
+	var (
+		head               = layout.Head(p)
+		diff               = layout.OverlayDiff(p)
+		snapshotsStatePath = layout.SnapshotsState(p)
+		snapshotsPath      = layout.Snapshots(p)
+		snapshotMountsPath = layout.SnapshotMounts(p)
+	)
+
+	// The ignore rules are looked up in the layers still mounted
+	layers, err := snapshotLayers(ss, p)
+	if err != nil {
+		return err
+	}
+
+	ign, err := loadIgnore(layers, layout.Orig(p))
+	if err != nil {
+		return fmt.Errorf("failed to read ignore rules: %v", err)
+	}
+
+	if err := device.Unmount(head); err != nil {
 		return fmt.Errorf("failed to unmount HEAD %s: %v", p, err)
 	}
 
@@ -192,7 +332,13 @@ func ApplySnapshot(p string, snapId int) error {
 
 	// Clean diff
 
-	if err = removeAllIn(diff); err != nil {
+	if ign != nil {
+		err = removeUnignored(diff, ign)
+	} else {
+		err = removeAllIn(diff)
+	}
+
+	if err != nil {
 		return fmt.Errorf("failed to clean diff: %v", err)
 	}
 
@@ -239,21 +385,100 @@ func ApplySnapshot(p string, snapId int) error {
 	return nil
 }
 
+// snapshotEntry describes a snapshot in JSON output
+type snapshotEntry struct {
+	Snapshot
+	Active bool `json:"active"`
+	// Size is the size of the compressed snapshot image
+	Size int64 `json:"size"`
+}
+
+// snapshotDetails describes a snapshot and its relationships in JSON output
+type snapshotDetails struct {
+	snapshotEntry
+	// Dependencies are the snapshots the snapshot is layered on, parent first
+	Dependencies []int `json:"dependencies"`
+	// ReverseDependencies are the snapshots layered directly on this one
+	ReverseDependencies []int `json:"reverse_dependencies"`
+}
+
+func newSnapshotEntry(p string, ss *SnapshotsState, snap Snapshot) (snapshotEntry, error) {
+	info, err := os.Lstat(path.Join(layout.Snapshots(p), layout.SnapshotFilename(snap.Id)))
+	if err != nil {
+		return snapshotEntry{}, err
+	}
+
+	return snapshotEntry{
+		Snapshot: snap,
+		Active:   ss.AppliedSnapshot == snap.Id,
+		Size:     info.Size(),
+	}, nil
+}
+
+// PrintNewSnapshot prints the ID of a snapshot that's just been created
+func PrintNewSnapshot(snapId int) error {
+	if output.Format == output.JSON {
+		return output.WriteJSON(struct {
+			Id int `json:"id"`
+		}{snapId})
+	}
+
+	_, err := fmt.Println(snapId)
+	return err
+}
+
 func PrintSnapshotsList(p string) error {
 	if err := checkTargetAndBaseDirs(p, layout.Base(p)); err != nil {
 		return err
 	}
 
+	l, err := lockEph(p, lock.Shared)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
 	ss, err := readSnapshotsState(layout.SnapshotsState(p))
 	if err != nil {
 		return fmt.Errorf("failed to read snapshots state: %v", err)
 	}
 
+	ids := make([]int, 0, len(ss.Snapshots))
+	for k := range ss.Snapshots {
+		ids = append(ids, k)
+	}
+
+	sort.Ints(ids)
+
+	switch output.Format {
+	case output.Porcelain:
+		w := output.NewWriter()
+
+		for _, k := range ids {
+			v := ss.Snapshots[k]
+			w.Record(strconv.Itoa(k), strconv.FormatBool(ss.AppliedSnapshot == k),
+				v.Created.Format(time.RFC3339Nano), output.Quote(v.Label))
+		}
+
+		return w.Flush()
+	case output.JSON:
+		entries := make([]snapshotEntry, len(ids))
+
+		for i, k := range ids {
+			if entries[i], err = newSnapshotEntry(p, ss, ss.Snapshots[k]); err != nil {
+				return err
+			}
+		}
+
+		return output.WriteJSON(entries)
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
 
 	fmt.Fprintln(w, "ID\tACTIVE\tCREATED\tLABEL")
 
-	for k, v := range ss.Snapshots {
+	for _, k := range ids {
+		v := ss.Snapshots[k]
 		active := ' '
 		if ss.AppliedSnapshot == k {
 			active = '*'
@@ -271,6 +496,12 @@ func PrintSnapshotDetails(p string, snapId int) error {
 		return err
 	}
 
+	l, err := lockEph(p, lock.Shared)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
 	ss, err := readSnapshotsState(layout.SnapshotsState(p))
 	if err != nil {
 		return fmt.Errorf("failed to read snapshots state: %v", err)
@@ -287,6 +518,12 @@ func PrintSnapshotDetails(p string, snapId int) error {
 	}
 
 	revDeps := reverseSnapshotDependencies(snapId, ss)
+	sort.Ints(revDeps)
+
+	entry, err := newSnapshotEntry(p, ss, snap)
+	if err != nil {
+		return err
+	}
 
 	intSliceToStrSlice := func(xs []int) []string {
 		ys := make([]string, len(xs))
@@ -299,22 +536,41 @@ func PrintSnapshotDetails(p string, snapId int) error {
 	depsStr := intSliceToStrSlice(deps)
 	revDepsStr := intSliceToStrSlice(revDeps)
 
-	info, err := os.Lstat(path.Join(layout.Snapshots(p), layout.SnapshotFilename(snapId)))
-	if err != nil {
-		return err
+	switch output.Format {
+	case output.Porcelain:
+		w := output.NewWriter()
+
+		w.Record("id", strconv.Itoa(snapId))
+		w.Record("parent", strconv.Itoa(snap.Parent))
+		w.Record("active", strconv.FormatBool(entry.Active))
+		w.Record("created", snap.Created.Format(time.RFC3339Nano))
+		w.Record("label", output.Quote(snap.Label))
+		w.Record(append([]string{"dependencies"}, depsStr...)...)
+		w.Record(append([]string{"reverse-dependencies"}, revDepsStr...)...)
+		w.Record("size", strconv.FormatInt(entry.Size, 10))
+
+		return w.Flush()
+	case output.JSON:
+		details := snapshotDetails{
+			snapshotEntry:       entry,
+			Dependencies:        append([]int{}, deps...),
+			ReverseDependencies: append([]int{}, revDeps...),
+		}
+
+		return output.WriteJSON(details)
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 0, ' ', 0)
 
 	fmt.Fprintf(w, "Snapshot ID:\t %d\n", snapId)
-	fmt.Fprintf(w, "Is active:\t %v\n", ss.AppliedSnapshot == snapId)
+	fmt.Fprintf(w, "Is active:\t %v\n", entry.Active)
 	fmt.Fprintf(w, "Created:\t %s\n", snap.Created)
 	fmt.Fprintf(w, "Label:\t %s\n", coalesceStr(snap.Label))
 	fmt.Fprintln(w, "")
 	fmt.Fprintf(w, "Dependencies:\t %v\n", coalesceStr(strings.Join(depsStr, "->")))
 	fmt.Fprintf(w, "Reverse dependencies:\t %v\n", coalesceStr(strings.Join(revDepsStr, ", ")))
 	fmt.Fprintln(w, "")
-	fmt.Fprintf(w, "Compressed size:\t %s\n", humanBytes(uint64(info.Size())))
+	fmt.Fprintf(w, "Compressed size:\t %s\n", humanBytes(uint64(entry.Size)))
 
 	w.Flush()
 
@@ -322,17 +578,26 @@ func PrintSnapshotDetails(p string, snapId int) error {
 }
 
 func snapshotDependencies(snapId int, ss *SnapshotsState) ([]int, error) {
-	var deps []int
+	var (
+		deps []int
+		seen = map[int]bool{snapId: true}
+	)
+
 	snapId = ss.Snapshots[snapId].Parent
 
 	for snapId != 0 {
-		nextSnapId := ss.Snapshots[snapId].Parent
-		if snapId == nextSnapId {
+		if seen[snapId] {
 			return nil, fmt.Errorf("circular dependency")
 		}
 
+		snap, ok := ss.Snapshots[snapId]
+		if !ok {
+			return nil, fmt.Errorf("snapshot %d does not exist", snapId)
+		}
+
+		seen[snapId] = true
 		deps = append(deps, snapId)
-		snapId = nextSnapId
+		snapId = snap.Parent
 	}
 
 	return deps, nil
@@ -47,6 +47,47 @@ func removeAllIn(dir string) error {
 	return iter.Err()
 }
 
+// writeFileAtomic writes data into a temporary file first
+// and renames it over p only once it's been synced to disk.
+func writeFileAtomic(p string, data []byte, perm os.FileMode) error {
+	tmp := p + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(path.Dir(p))
+}
+
+func syncDir(p string) error {
+	d, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
 func coalesceStr(s string) string {
 	if s == "" {
 		return "<none>"
@@ -0,0 +1,478 @@
+package eph
+
+import (
+	"github.com/gman0/eph/pkg/device"
+	"github.com/gman0/eph/pkg/diriter"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// layerDir is a directory in one of the ramdisk layers, or in orig,
+// that contributes to the contents of a directory in the overlay
+type layerDir struct {
+	// root of the layer
+	root string
+	// path of the directory, which may differ from the overlay's
+	// path in layers below a renamed directory
+	path string
+}
+
+// change describes a single dirent as seen in the overlay
+// along with its status relative to orig.
+type change struct {
+	// layer is the root of the topmost layer containing the dirent,
+	// or orig for unchanged dirents of renamed directories
+	layer   string
+	relPath string
+	// origPath is the path of the dirent's original version relative
+	// to orig. It differs from relPath in renamed directories.
+	origPath string
+	// source is the absolute path of the dirent in layer
+	source   string
+	info     os.FileInfo
+	origInfo os.FileInfo
+	status   changeStatusCode
+
+	// replaced is set for directories which exist in orig, but whose
+	// contents there are hidden by the overlay: they are opaque or have
+	// been renamed from elsewhere. These replace orig's version as a whole.
+	replaced bool
+	// dirs make up the contents of a directory, topmost first
+	dirs []layerDir
+	// redirects is set for added and replaced directories containing
+	// directories renamed from elsewhere with redirect_dir
+	redirects bool
+
+	// Set by walkChanges callbacks to override descend():
+	// prune skips the children, expand walks the children
+	// of an added or replaced directory
+	prune  bool
+	expand bool
+}
+
+func (c *change) stagingPath() string {
+	return c.source
+}
+
+// isTypeChange is true for modified dirents that changed from a directory
+// into a non-directory or vice versa.
+func (c *change) isTypeChange() bool {
+	return c.status == statusModified && c.info.IsDir() != c.origInfo.IsDir()
+}
+
+// isWhole is true for dirents that replace their versions in orig, if any,
+// including all of their contents.
+func (c *change) isWhole() bool {
+	return c.status == statusAdded || c.replaced || c.isTypeChange()
+}
+
+// isComposite is true for directories whose contents come from more
+// than one layer, so that they can't be copied from a single place
+func (c *change) isComposite() bool {
+	return len(c.dirs) > 1 || c.redirects
+}
+
+// descend is true when the children of the dirent need to be walked
+// individually. Added and replaced directories are handled as a whole,
+// unless their contents are spread across multiple layers.
+func (c *change) descend() bool {
+	if c.prune {
+		return false
+	}
+
+	if c.expand {
+		return true
+	}
+
+	if !c.info.IsDir() {
+		return false
+	}
+
+	if c.isWhole() {
+		return c.isComposite()
+	}
+
+	return true
+}
+
+type changeWalker struct {
+	orig string
+	// layers are the roots of all layers, topmost first, orig last
+	layers []layerDir
+	// content makes files copied up into the ramdisk without
+	// any changes to be compared against orig, see sameContents
+	content bool
+	fn      func(c *change) error
+}
+
+// walkChanges walks the overlay made of the ramdisk layers, the most recent
+// one last, on top of orig. fn is called for each dirent found in any of
+// the layers, the way OverlayFS would resolve it: whiteouts and opaque
+// directories hide lower layers, and contents of directories renamed
+// with redirect_dir are looked up where they were renamed from.
+// Renamed directories are reported as such when their original
+// version can simply be moved, see resolveRename.
+//
+// If content is set, files whose contents and metadata are the same
+// as in orig are left out.
+func walkChanges(layers []string, orig string, content bool, fn func(c *change) error) error {
+	w := newChangeWalker(layers, orig, content, fn)
+
+	return w.walkDir("", "", w.layers, false)
+}
+
+func newChangeWalker(layers []string, orig string, content bool, fn func(c *change) error) *changeWalker {
+	dirs := make([]layerDir, 0, len(layers)+1)
+	for i := len(layers) - 1; i >= 0; i-- {
+		dirs = append(dirs, layerDir{layers[i], layers[i]})
+	}
+
+	dirs = append(dirs, layerDir{orig, orig})
+
+	return &changeWalker{orig: orig, layers: dirs, content: content, fn: fn}
+}
+
+// walkPath calls fn for relPath and the dirents under it the same way
+// walkChanges would, without walking the rest of the overlay. If relPath
+// is inside a directory that's handled as a whole, the directory is
+// reported instead. The path of the reported subtree is returned.
+// Nothing is reported if the subtree hasn't changed.
+func (w *changeWalker) walkPath(relPath string) (string, error) {
+	if relPath == "" {
+		return "", w.walkDir("", "", w.layers, false)
+	}
+
+	var (
+		dirs     = w.layers
+		origPath string
+		fresh    bool
+		cur      string
+	)
+
+	for _, name := range strings.Split(relPath[1:], "/") {
+		cur += "/" + name
+
+		c, err := w.resolveChange(cur, origPath+"/"+name, dirs, fresh)
+		if err != nil || c == nil {
+			return cur, err
+		}
+
+		if cur == relPath || !c.descend() {
+			if err = w.fn(c); err != nil {
+				return cur, err
+			}
+
+			if c.descend() {
+				err = w.walkDir(c.relPath, c.origPath, c.dirs, fresh || c.isWhole())
+			}
+
+			return cur, err
+		}
+
+		origPath, dirs, fresh = c.origPath, c.dirs, fresh || c.isWhole()
+	}
+
+	return cur, nil
+}
+
+// walkDir walks the children of directory relPath made of dirs, whose
+// original version is origPath. A fresh directory replaces orig's version
+// as a whole, its children are not compared against orig.
+func (w *changeWalker) walkDir(relPath, origPath string, dirs []layerDir, fresh bool) error {
+	names, err := readDirNames(w.orig+origPath, dirs)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		c, err := w.resolveChange(relPath+"/"+name, origPath+"/"+name, dirs, fresh)
+		if err != nil {
+			return err
+		}
+
+		if c == nil {
+			continue
+		}
+
+		if err = w.fn(c); err != nil {
+			return err
+		}
+
+		if c.descend() {
+			if err = w.walkDir(c.relPath, c.origPath, c.dirs, fresh || c.isWhole()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readDirNames lists the sorted names of dirents found in any of dirs.
+// Dirents found only in origDir are unchanged and are left out.
+func readDirNames(origDir string, dirs []layerDir) ([]string, error) {
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+
+	for _, d := range dirs {
+		if d.path == origDir {
+			continue
+		}
+
+		iter, err := diriter.NewIter(d.path)
+		if err != nil {
+			return nil, err
+		}
+
+		for ; !iter.AtEnd(); iter.Increment() {
+			name := iter.FileInfo().Name()
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+
+		err = iter.Err()
+		iter.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// lookup finds dirent name in dirs, the contents of its parent directory.
+// Only the layers that make up the dirent are included in the result,
+// info is nil if there are none.
+func (w *changeWalker) lookup(name string, dirs []layerDir) (*change, error) {
+	var (
+		c = &change{}
+		// Once a directory renamed from another parent is found,
+		// it's looked up by its absolute path in the layers below
+		absPath string
+	)
+
+	for i := 0; i < len(dirs); i++ {
+		d := dirs[i]
+
+		p := d.path + "/" + name
+		if absPath != "" {
+			p = d.root + absPath
+		}
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		if c.info == nil {
+			c.layer, c.source, c.info = d.root, p, info
+		}
+
+		if !info.IsDir() || !c.info.IsDir() {
+			// Directories hide non-directories in lower layers and vice versa
+			break
+		}
+
+		c.dirs = append(c.dirs, layerDir{d.root, p})
+
+		if d.root == w.orig {
+			break
+		}
+
+		isOpaque, err := device.IsOpaque(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if isOpaque {
+			break
+		}
+
+		r, err := device.Redirect(p)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case r == "":
+		case strings.HasPrefix(r, "/"):
+			absPath = r
+			dirs, i = w.layersBelow(d.root), -1
+		case absPath != "":
+			absPath = path.Join(path.Dir(absPath), r)
+		default:
+			name = r
+		}
+	}
+
+	return c, nil
+}
+
+func (w *changeWalker) layersBelow(root string) []layerDir {
+	for i := range w.layers {
+		if w.layers[i].root == root {
+			return w.layers[i+1:]
+		}
+	}
+
+	return nil
+}
+
+// lookupPath finds relPath in the overlay. info is nil if it doesn't exist,
+// or a whiteout if it's been deleted.
+func (w *changeWalker) lookupPath(relPath string) (*change, error) {
+	var (
+		dirs  = w.layers
+		names = strings.Split(relPath[1:], "/")
+		c     *change
+		err   error
+	)
+
+	for i, name := range names {
+		if c, err = w.lookup(name, dirs); err != nil {
+			return nil, err
+		}
+
+		if i == len(names)-1 || c.info == nil || !c.info.IsDir() {
+			break
+		}
+
+		dirs = c.dirs
+	}
+
+	return c, nil
+}
+
+// resolveChange looks up relPath in dirs, the contents of its parent,
+// and finds its status relative to origPath in orig. nil is returned
+// for dirents that haven't changed.
+func (w *changeWalker) resolveChange(relPath, origPath string, dirs []layerDir, fresh bool) (*change, error) {
+	orig := w.orig
+
+	c, err := w.lookup(path.Base(relPath), dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.info == nil || c.source == orig+origPath && !fresh {
+		return nil, nil
+	}
+
+	c.relPath, c.origPath = relPath, origPath
+
+	isRenamed, err := w.resolveRename(c, fresh)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isRenamed {
+		if err = resolveChangeStatusCode(orig, c, fresh, w.content); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.status == statusSkip && !c.info.IsDir() {
+		// A whiteout of a dirent that's not in orig,
+		// or a file that's been copied up unchanged
+		return nil, nil
+	}
+
+	if c.info.IsDir() && c.isWhole() && len(c.dirs) == 1 && c.layer != orig {
+		if c.redirects, err = hasRedirects(c.source); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// resolveRename recognizes a directory renamed with redirect_dir whose
+// original version can be moved to the new path in orig: there's nothing
+// in the way, the old path is gone from the overlay, and its parent
+// is still where it was. Its contents are then compared against
+// the original version.
+func (w *changeWalker) resolveRename(c *change, fresh bool) (bool, error) {
+	if !c.info.IsDir() {
+		return false, nil
+	}
+
+	last := c.dirs[len(c.dirs)-1]
+	if last.root != w.orig || last.path == w.orig+c.origPath {
+		return false, nil
+	}
+
+	from := last.path[len(w.orig):]
+
+	if !fresh {
+		if _, err := os.Lstat(w.orig + c.origPath); !isNotExist(err) {
+			return false, err
+		}
+	}
+
+	old, err := w.lookupPath(from)
+	if err != nil {
+		return false, err
+	}
+
+	if old.info != nil && !device.IsWhiteout(old.info) {
+		// A copy rather than a rename
+		return false, nil
+	}
+
+	if parent := path.Dir(from); parent != "/" {
+		pc, err := w.lookupPath(parent)
+		if err != nil {
+			return false, err
+		}
+
+		if pc.info == nil || !pc.info.IsDir() || pc.dirs[len(pc.dirs)-1] != (layerDir{w.orig, w.orig + parent}) {
+			return false, nil
+		}
+	}
+
+	if c.origInfo, err = os.Lstat(last.path); err != nil {
+		return false, err
+	}
+
+	c.origPath = from
+	c.status = statusRenamed
+
+	return true, nil
+}
+
+// hasRedirects checks whether there are any renamed directories
+// in the tree at p, whose contents come from elsewhere
+func hasRedirects(p string) (bool, error) {
+	iter, err := diriter.NewRecursiveIter(p)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+
+	for !iter.AtEnd() {
+		if iter.FileInfo().IsDir() {
+			r, err := device.Redirect(path.Join(iter.Base(), iter.FileInfo().Name()))
+			if err != nil || r != "" {
+				return r != "", err
+			}
+		}
+
+		if iter.Increment(); iter.Err() != nil {
+			return false, iter.Err()
+		}
+	}
+
+	return false, nil
+}
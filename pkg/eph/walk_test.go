@@ -0,0 +1,168 @@
+package eph
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "eph-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func mustMkdir(t *testing.T, p string, mode os.FileMode) {
+	t.Helper()
+
+	if err := os.Mkdir(p, mode); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not affected by umask
+	if err := os.Chmod(p, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustWriteFile(t *testing.T, p, data string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type walkedChange struct {
+	status   changeStatusCode
+	origPath string
+}
+
+func mustWhiteout(t *testing.T, p string) {
+	t.Helper()
+
+	if err := unix.Mknod(p, unix.S_IFCHR|0000, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSetXattr(t *testing.T, p, name, val string) {
+	t.Helper()
+
+	if err := unix.Lsetxattr(p, name, []byte(val), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func walkAll(t *testing.T, layers []string, orig string) map[string]walkedChange {
+	t.Helper()
+
+	changes := make(map[string]walkedChange)
+
+	err := walkChanges(layers, orig, false, func(c *change) error {
+		if _, ok := changes[c.relPath]; ok {
+			t.Errorf("%s reported twice", c.relPath)
+		}
+
+		changes[c.relPath] = walkedChange{c.status, c.origPath}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return changes
+}
+
+func TestWalkChanges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("whiteouts and trusted xattrs need root")
+	}
+
+	var (
+		tmp   = tempDir(t)
+		orig  = path.Join(tmp, "orig")
+		lower = path.Join(tmp, "lower")
+		upper = path.Join(tmp, "upper")
+	)
+
+	for _, dir := range []string{orig, lower, upper} {
+		mustMkdir(t, dir, 0755)
+	}
+
+	// orig:
+	//   keep/a    renamed to opq/moved in upper
+	//   gone      deleted in lower
+	//   opq/x     hidden by opaque opq in upper
+	//   olddir/b  renamed to renamed in lower
+	//   same/c    unchanged
+	mustMkdir(t, path.Join(orig, "keep"), 0755)
+	mustWriteFile(t, path.Join(orig, "keep", "a"), "a")
+	mustWriteFile(t, path.Join(orig, "gone"), "gone")
+	mustMkdir(t, path.Join(orig, "opq"), 0755)
+	mustWriteFile(t, path.Join(orig, "opq", "x"), "x")
+	mustMkdir(t, path.Join(orig, "olddir"), 0755)
+	mustWriteFile(t, path.Join(orig, "olddir", "b"), "b")
+	mustMkdir(t, path.Join(orig, "same"), 0755)
+	mustWriteFile(t, path.Join(orig, "same", "c"), "c")
+
+	// lower: olddir renamed to renamed with redirect_dir,
+	// with a new file in it,
+	// gone deleted, ghost created and deleted again
+	mustMkdir(t, path.Join(lower, "renamed"), 0755)
+	mustSetXattr(t, path.Join(lower, "renamed"), "trusted.overlay.redirect", "olddir")
+	mustWriteFile(t, path.Join(lower, "renamed", "new"), "new")
+	mustWhiteout(t, path.Join(lower, "olddir"))
+	mustWhiteout(t, path.Join(lower, "gone"))
+	mustWhiteout(t, path.Join(lower, "ghost"))
+
+	// upper: opq recreated as an opaque directory with a new file,
+	// keep renamed into it
+	mustMkdir(t, path.Join(upper, "opq"), 0755)
+	mustSetXattr(t, path.Join(upper, "opq"), "trusted.overlay.opaque", "y")
+	mustWriteFile(t, path.Join(upper, "opq", "z"), "z")
+	mustMkdir(t, path.Join(upper, "opq", "moved"), 0755)
+	mustSetXattr(t, path.Join(upper, "opq", "moved"), "trusted.overlay.redirect", "/keep")
+	mustWhiteout(t, path.Join(upper, "keep"))
+
+	changes := walkAll(t, []string{lower, upper}, orig)
+
+	expected := map[string]walkedChange{
+		"/gone":        {statusDeleted, "/gone"},
+		"/keep":        {statusDeleted, "/keep"},
+		"/olddir":      {statusDeleted, "/olddir"},
+		"/opq":         {statusModified, "/opq"},
+		"/opq/moved":   {statusRenamed, "/keep"},
+		"/opq/z":       {statusAdded, "/opq/z"},
+		"/renamed":     {statusRenamed, "/olddir"},
+		"/renamed/new": {statusAdded, "/olddir/new"},
+	}
+
+	for relPath, want := range expected {
+		got, ok := changes[relPath]
+		if !ok {
+			t.Errorf("%s: not reported, expected %c %s", relPath, want.status, want.origPath)
+			continue
+		}
+
+		if got != want {
+			t.Errorf("%s: %c %s, expected %c %s", relPath, got.status, got.origPath, want.status, want.origPath)
+		}
+	}
+
+	for relPath, got := range changes {
+		if _, ok := expected[relPath]; !ok {
+			t.Errorf("%s: unexpected %c %s", relPath, got.status, got.origPath)
+		}
+	}
+}
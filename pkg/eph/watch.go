@@ -0,0 +1,406 @@
+package eph
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gman0/eph/pkg/diriter"
+	"github.com/gman0/eph/pkg/ignore"
+	"github.com/gman0/eph/pkg/layout"
+	"golang.org/x/sys/unix"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// watchEvent tells how a change reported by status --watch differs
+// from the one printed before for the same path
+type watchEvent string
+
+const (
+	// watchAdd is a path that's newly changed
+	watchAdd watchEvent = "add"
+	// watchModify is a changed path whose status, type, size
+	// or modification time is different now
+	watchModify watchEvent = "modify"
+	// watchDelete is a path that no longer differs from orig
+	watchDelete watchEvent = "delete"
+)
+
+const (
+	inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB |
+		unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+	// Events are collected until none have come for settleTime,
+	// or for at most maxBatchTime, before the changes are printed
+	settleTime   = 100 * time.Millisecond
+	maxBatchTime = time.Second
+)
+
+// watchedEntry is a change printed by status, along with the modification
+// time of the dirent, so that files modified later can be recognized
+type watchedEntry struct {
+	statusEntry
+	mtime time.Time
+}
+
+// statusWatcher keeps the status of a ramdisk up to date by watching
+// for changes in the upper layer of the overlay with inotify. Only the
+// paths that the events have been reported for are walked again.
+type statusWatcher struct {
+	p    string
+	opts StatusOptions
+	sp   *statusPrinter
+	w    *changeWalker
+	ign  *ignore.Matcher
+	diff string
+
+	fd int
+	// dirs are the paths of the watched directories in diff
+	// by their watch descriptors
+	dirs map[int32]string
+	// stateWd watches the snapshots state, which is rewritten
+	// whenever a snapshot is applied
+	stateWd int32
+}
+
+// watchStatus prints the changes made to ramdisk p as they happen, until
+// the ramdisk is unmounted. The changes already printed by sp are the base
+// the new ones are compared against. Renamed files are only recognized
+// in the initial status, later they are reported as added and deleted.
+func watchStatus(p string, opts StatusOptions, sp *statusPrinter) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %v", err)
+	}
+	defer unix.Close(fd)
+
+	sw := &statusWatcher{
+		p:    p,
+		opts: opts,
+		sp:   sp,
+		diff: layout.OverlayDiff(p),
+		fd:   fd,
+		dirs: make(map[int32]string),
+	}
+
+	stateWd, err := unix.InotifyAddWatch(fd, layout.Snapshots(p), unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_ONLYDIR)
+	if err != nil {
+		return fmt.Errorf("failed to watch snapshots state: %v", err)
+	}
+
+	sw.stateWd = int32(stateWd)
+
+	if err = sw.loadLayers(); err != nil {
+		return err
+	}
+
+	if err = sw.watchTree(""); err != nil {
+		return err
+	}
+
+	// Changes made before the watches were in place would go unnoticed
+	if err = sw.refresh([]string{""}); err != nil {
+		return err
+	}
+
+	for {
+		paths, reload, err := sw.readEvents()
+		if err != nil {
+			return err
+		}
+
+		if reload {
+			if err = sw.loadLayers(); err != nil {
+				return err
+			}
+			paths = []string{""}
+		}
+
+		if err = sw.refresh(paths); err != nil {
+			return err
+		}
+	}
+}
+
+// loadLayers sets up the walker for the layers the overlay is made of,
+// along with the ignore rules found in them
+func (sw *statusWatcher) loadLayers() error {
+	ss, err := readSnapshotsState(layout.SnapshotsState(sw.p))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshots state: %v", err)
+	}
+
+	layers, err := snapshotLayers(ss, sw.p)
+	if err != nil {
+		return err
+	}
+
+	if sw.ign, err = loadIgnore(layers, layout.Orig(sw.p)); err != nil {
+		return fmt.Errorf("failed to read ignore rules: %v", err)
+	}
+
+	sw.sp.layerIds = snapshotLayerIds(ss, sw.p)
+	sw.w = newChangeWalker(layers, layout.Orig(sw.p), sw.opts.Content, nil)
+
+	return nil
+}
+
+// watchTree adds watches for directory relPath in diff and all of its
+// subdirectories. Directories that are gone in the meantime are skipped.
+func (sw *statusWatcher) watchTree(relPath string) error {
+	wd, err := unix.InotifyAddWatch(sw.fd, sw.diff+relPath, inotifyMask)
+	if err != nil {
+		if err == unix.ENOENT || err == unix.ENOTDIR {
+			return nil
+		}
+		return fmt.Errorf("failed to watch %s: %v", sw.diff+relPath, err)
+	}
+
+	// A directory that's been moved keeps its watch descriptor
+	sw.dirs[int32(wd)] = relPath
+
+	iter, err := diriter.NewIter(sw.diff + relPath)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer iter.Close()
+
+	for ; !iter.AtEnd(); iter.Increment() {
+		if iter.FileInfo().IsDir() {
+			if err = sw.watchTree(relPath + "/" + iter.FileInfo().Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return iter.Err()
+}
+
+// readEvents waits for changes in diff and collects the paths they've
+// been made to. reload is set when the overlay's layers or the ignore
+// rules have changed.
+func (sw *statusWatcher) readEvents() (paths []string, reload bool, err error) {
+	var (
+		buf      = make([]byte, 64*1024)
+		deadline time.Time
+		seen     = make(map[string]bool)
+	)
+
+	for {
+		timeout := -1
+		if !deadline.IsZero() {
+			timeout = int(time.Until(deadline) / time.Millisecond)
+			if settle := int(settleTime / time.Millisecond); timeout > settle {
+				timeout = settle
+			}
+			if timeout <= 0 {
+				return paths, reload, nil
+			}
+		}
+
+		n, err := unix.Poll([]unix.PollFd{{Fd: int32(sw.fd), Events: unix.POLLIN}}, timeout)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return nil, false, err
+		}
+
+		if n == 0 {
+			return paths, reload, nil
+		}
+
+		if deadline.IsZero() {
+			deadline = time.Now().Add(maxBatchTime)
+		}
+
+		if n, err = unix.Read(sw.fd, buf); err != nil {
+			return nil, false, fmt.Errorf("failed to read inotify events: %v", err)
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(bytes.TrimRight(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(ev.Len)], "\x00"))
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+				// Events have been lost, everything needs to be checked
+				paths, seen = []string{""}, map[string]bool{"": true}
+				continue
+			}
+
+			if ev.Wd == sw.stateWd {
+				if ev.Mask&unix.IN_IGNORED != 0 {
+					return nil, false, fmt.Errorf("stopped watching: ramdisk %s is no longer mounted", sw.p)
+				}
+				reload = reload || name == path.Base(layout.SnapshotsState(sw.p))
+				continue
+			}
+
+			dir, ok := sw.dirs[ev.Wd]
+			if !ok {
+				continue
+			}
+
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(sw.dirs, ev.Wd)
+				if dir == "" {
+					return nil, false, fmt.Errorf("stopped watching: ramdisk %s is no longer mounted", sw.p)
+				}
+				continue
+			}
+
+			if name == "" {
+				// The watched directory itself, its parent reports it too
+				continue
+			}
+
+			relPath := dir + "/" + name
+
+			if ev.Mask&unix.IN_ISDIR != 0 && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				if err = sw.watchTree(relPath); err != nil {
+					return nil, false, err
+				}
+			}
+
+			if relPath == ephignoreFile || relPath == gitignoreFile {
+				reload = true
+			}
+
+			if !seen[relPath] {
+				seen[relPath] = true
+				paths = append(paths, relPath)
+			}
+		}
+	}
+}
+
+// refresh walks paths again and prints how their changes differ
+// from the ones printed before
+func (sw *statusWatcher) refresh(paths []string) error {
+	sort.Strings(paths)
+
+	for i, p := range paths {
+		if i > 0 && isSubtree(paths[i-1], p) {
+			// Walked along with its ancestor, which is sorted before it
+			paths[i] = paths[i-1]
+			continue
+		}
+
+		if sw.ign.MatchParents(strings.TrimPrefix(p, "/")) {
+			// Nothing inside of ignored directories is reported
+			continue
+		}
+
+		if err := sw.refreshPath(p); err != nil {
+			return err
+		}
+	}
+
+	return sw.sp.flush()
+}
+
+func (sw *statusWatcher) refreshPath(relPath string) error {
+	var (
+		changes []*change
+		current = make(map[string]watchedEntry)
+		// Original paths of renamed dirents, their whiteouts aren't reported
+		renamed = make(map[string]bool)
+	)
+
+	sw.w.fn = func(c *change) error {
+		if isIgnored(sw.ign, c) {
+			c.prune = true
+			return nil
+		}
+
+		changes = append(changes, c)
+		return nil
+	}
+
+	root, err := sw.w.walkPath(relPath)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range sw.sp.known {
+		if e.From != "" {
+			renamed["/"+e.From] = true
+		}
+	}
+
+	for _, c := range changes {
+		if c.status == statusDeleted && renamed[c.relPath] {
+			continue
+		}
+
+		from := ""
+		if c.status == statusRenamed {
+			from = c.origPath
+		}
+
+		if e, ok := sw.sp.entry(c, c.info, c.relPath, from, c.status); ok {
+			current[e.Path] = e
+		}
+	}
+
+	var gone []string
+	for p := range sw.sp.known {
+		if _, ok := current[p]; !ok && isSubtree(root, "/"+p) {
+			gone = append(gone, p)
+		}
+	}
+
+	sort.Strings(gone)
+
+	for _, p := range gone {
+		e := sw.sp.known[p].statusEntry
+		delete(sw.sp.known, p)
+
+		e.Event = watchDelete
+		sw.sp.write(e)
+	}
+
+	for _, c := range changes {
+		e, ok := current[c.relPath[1:]]
+		if !ok {
+			continue
+		}
+
+		if old, ok := sw.sp.known[e.Path]; !ok {
+			e.Event = watchAdd
+		} else if isModified(old, e) {
+			e.Event = watchModify
+		} else {
+			continue
+		}
+
+		sw.sp.known[e.Path] = e
+		sw.sp.write(e.statusEntry)
+	}
+
+	return nil
+}
+
+// isSubtree is true if relPath is root or if it's inside of it
+func isSubtree(root, relPath string) bool {
+	return root == "" || relPath == root || strings.HasPrefix(relPath, root+"/")
+}
+
+// isModified compares the changes printed for the same path. Modification
+// times of directories are left out, they change along with their contents.
+func isModified(old, e watchedEntry) bool {
+	if old.Code != e.Code || old.Type != e.Type || old.From != e.From || old.Layer != e.Layer {
+		return true
+	}
+
+	if e.Type == "directory" {
+		return false
+	}
+
+	return old.Size != e.Size || !old.mtime.Equal(e.mtime)
+}
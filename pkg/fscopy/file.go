@@ -0,0 +1,364 @@
+package fscopy
+
+import (
+	"errors"
+	"github.com/gman0/eph/pkg/beneath"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	// FICLONE ioctl shares the extents of a file with another one on CoW filesystems
+	ficlone = 0x40049409
+
+	seekData = 3
+	seekHole = 4
+
+	// Largest chunk copied at once, Stop is checked between the chunks
+	copyChunk = 1 << 26
+
+	// Internal xattrs of OverlayFS, e.g. trusted.overlay.opaque,
+	// are meaningless outside of the overlay's upper layer
+	overlayXattrPrefix = "trusted.overlay."
+)
+
+// copyDirent copies a single non-directory dirent along with its attributes.
+// Copying a regular file is interrupted with ErrInterrupted once stop is
+// closed, a nil stop lets it finish.
+func copyDirent(src, dst string, info os.FileInfo, stop <-chan struct{}) error {
+	var (
+		err error
+		st  = info.Sys().(*syscall.Stat_t)
+	)
+
+	switch {
+	case info.Mode().IsRegular():
+		err = copyFile(src, dst, st, stop)
+	case info.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(src); err == nil {
+			err = os.Symlink(target, dst)
+		}
+	case info.IsDir():
+		err = os.Mkdir(dst, 0700)
+	default:
+		// Device nodes, FIFOs and sockets
+		err = unix.Mknod(dst, st.Mode&unix.S_IFMT|0600, int(st.Rdev))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return copyAttrs(src, dst, info)
+}
+
+// copyFile copies the contents of a regular file. The data is shared
+// with the source if the filesystem supports reflinks, otherwise
+// it's copied in the kernel if possible. Holes in sparse files are kept.
+func copyFile(src, dst string, st *syscall.Stat_t, stop <-chan struct{}) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err = copyContents(in, out, st, stop); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func copyContents(in, out *os.File, st *syscall.Stat_t, stop <-chan struct{}) error {
+	if err := unix.IoctlSetInt(int(out.Fd()), ficlone, int(in.Fd())); err == nil {
+		return nil
+	}
+
+	if st.Blocks*512 < st.Size {
+		if err := copySparse(in, out, st.Size, stop); err != errNoSeekData {
+			return err
+		}
+	}
+
+	return copyRange(in, out, 0, -1, stop)
+}
+
+var errNoSeekData = errors.New("SEEK_DATA not supported")
+
+// copySparse copies only the data segments of the file, skipping the holes
+func copySparse(in, out *os.File, size int64, stop <-chan struct{}) error {
+	for off := int64(0); off < size; {
+		if isStopped(stop) {
+			return ErrInterrupted
+		}
+
+		data, err := unix.Seek(int(in.Fd()), off, seekData)
+		if err != nil {
+			if err == unix.ENXIO {
+				// Only a hole remains
+				break
+			}
+			if off == 0 && err == unix.EINVAL {
+				return errNoSeekData
+			}
+			return err
+		}
+
+		hole, err := unix.Seek(int(in.Fd()), data, seekHole)
+		if err != nil {
+			return err
+		}
+
+		if err = copyRange(in, out, data, hole-data, stop); err != nil {
+			return err
+		}
+
+		off = hole
+	}
+
+	return unix.Ftruncate(int(out.Fd()), size)
+}
+
+// copyRange copies length bytes at offset off, or everything
+// up to the end of the file if length is negative
+func copyRange(in, out *os.File, off, length int64, stop <-chan struct{}) error {
+	for inOff, outOff := off, off; length != 0; {
+		if isStopped(stop) {
+			return ErrInterrupted
+		}
+
+		chunk := int64(copyChunk)
+		if length > 0 && length < chunk {
+			chunk = length
+		}
+
+		n, err := unix.CopyFileRange(int(in.Fd()), &inOff, int(out.Fd()), &outOff, int(chunk), 0)
+		if err != nil {
+			if inOff == off && isCopyUnsupported(err) {
+				// Nothing has been copied yet, fall back to read/write
+				return readWriteRange(in, out, off, length, stop)
+			}
+			return err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		if length > 0 {
+			length -= int64(n)
+		}
+	}
+
+	return nil
+}
+
+func readWriteRange(in, out *os.File, off, length int64, stop <-chan struct{}) error {
+	var r io.Reader = io.NewSectionReader(in, off, 1<<62)
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+
+	_, err := io.Copy(&offsetWriter{out, off}, &stopReader{r, stop})
+	return err
+}
+
+// stopReader fails with ErrInterrupted once stop is closed
+type stopReader struct {
+	r    io.Reader
+	stop <-chan struct{}
+}
+
+func (r *stopReader) Read(b []byte) (int, error) {
+	if isStopped(r.stop) {
+		return 0, ErrInterrupted
+	}
+
+	return r.r.Read(b)
+}
+
+// isStopped is true once stop is closed, never if it's nil
+func isStopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	n, err := w.f.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// isCopyUnsupported is true for errors of copy_file_range that mean
+// it can't be used for the given files, e.g. on older kernels or across
+// filesystems
+func isCopyUnsupported(err error) bool {
+	switch err {
+	case unix.ENOSYS, unix.EXDEV, unix.EOPNOTSUPP, unix.EINVAL, unix.EBADF:
+		return true
+	}
+
+	return false
+}
+
+// copyAttrs sets ownership, permissions, extended attributes
+// and timestamps of dst to those of src
+func copyAttrs(src, dst string, info os.FileInfo) error {
+	st := info.Sys().(*syscall.Stat_t)
+
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		// chown clears setuid and setgid bits, chmod needs to come after it
+		if err := beneath.Chmod(dst, info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	// ACLs are stored in system.posix_acl_* xattrs. They're set after
+	// chmod, which would otherwise overwrite the ACL mask.
+	if err := CopyXattrs(src, dst); err != nil {
+		return err
+	}
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(st.Atim.Nano()),
+		unix.NsecToTimespec(st.Mtim.Nano()),
+	}
+
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// CopyXattrs sets the extended attributes of dst to those of src,
+// removing the ones src doesn't have. Internal xattrs of OverlayFS
+// are left out, as well as security labels set by the system.
+func CopyXattrs(src, dst string) error {
+	srcXattrs, err := Xattrs(src)
+	if err != nil {
+		return err
+	}
+
+	return SetXattrs(dst, srcXattrs)
+}
+
+// SetXattrs replaces the extended attributes of dst, except for
+// the security ones, with xattrs. Symlinks are not followed.
+func SetXattrs(dst string, xattrs map[string][]byte) error {
+	dstXattrs, err := Xattrs(dst)
+	if err != nil {
+		return err
+	}
+
+	for name := range dstXattrs {
+		if _, ok := xattrs[name]; ok || strings.HasPrefix(name, "security.") {
+			continue
+		}
+
+		if err = unix.Lremovexattr(dst, name); err != nil && err != unix.ENODATA {
+			return &os.PathError{Op: "removexattr " + name, Path: dst, Err: err}
+		}
+	}
+
+	for name, val := range xattrs {
+		if err = unix.Lsetxattr(dst, name, val, 0); err != nil {
+			if err == unix.ENOTSUP || err == unix.EPERM && strings.HasPrefix(name, "user.") {
+				// Not supported by dst's filesystem, or user xattrs on a symlink
+				continue
+			}
+			return &os.PathError{Op: "setxattr " + name, Path: dst, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Xattrs returns the extended attributes of p, except for the internal
+// ones of OverlayFS. Symlinks are not followed.
+func Xattrs(p string) (map[string][]byte, error) {
+	names, err := listXattrs(p)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte, len(names))
+
+	for _, name := range names {
+		if strings.HasPrefix(name, overlayXattrPrefix) {
+			continue
+		}
+
+		val, err := getXattr(p, name)
+		if err != nil {
+			if err == unix.ENODATA {
+				continue
+			}
+			return nil, err
+		}
+
+		xattrs[name] = val
+	}
+
+	return xattrs, nil
+}
+
+func listXattrs(p string) ([]string, error) {
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	if sz, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for start, i := 0, 0; i < sz; i++ {
+		if buf[i] == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+
+	return names, nil
+}
+
+func getXattr(p, name string) ([]byte, error) {
+	sz, err := unix.Lgetxattr(p, name, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	if sz, err = unix.Lgetxattr(p, name, buf); err != nil {
+		return nil, err
+	}
+
+	return buf[:sz], nil
+}
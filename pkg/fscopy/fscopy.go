@@ -0,0 +1,398 @@
+// Package fscopy copies directory trees in-process, preserving ownership,
+// permissions, nanosecond timestamps, extended attributes and ACLs,
+// hardlinks and holes in sparse files.
+package fscopy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gman0/eph/pkg/beneath"
+	"github.com/gman0/eph/pkg/diriter"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// Workers is the number of files copied concurrently
+var Workers = 4 * runtime.NumCPU()
+
+type fileJob struct {
+	src, dst string
+	info     os.FileInfo
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+type hardlink struct {
+	oldname, newname string
+}
+
+// ErrInterrupted is returned by Copier.Tree once Stop is closed
+var ErrInterrupted = errors.New("interrupted")
+
+// Copier copies directory trees, see Tree.
+type Copier struct {
+	// Progress is called for each copied dirent with its apparent size,
+	// concurrently from multiple goroutines
+	Progress func(files int, bytes int64)
+	// Stop makes the copy stop once it's closed. Files that are
+	// being copied at that moment are finished first, unless only
+	// a single file is copied.
+	Stop <-chan struct{}
+	// Links keeps hardlinks together across the copies sharing it, if set.
+	// Otherwise only the links within a single copy are kept.
+	Links *Links
+}
+
+// Links records the first copies of inodes with multiple links. Other links
+// to the inodes copied later on are created as links to their first copies,
+// wherever these have been moved in the meantime.
+type Links struct {
+	mu sync.Mutex
+	// O_PATH descriptors of the first copies
+	copies map[inode]int
+}
+
+func NewLinks() *Links {
+	return &Links{copies: make(map[inode]int)}
+}
+
+// link creates dst as a link to the first copy of ino.
+// false is returned if it hasn't been copied yet.
+func (l *Links) link(ino inode, dst string) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+
+	l.mu.Lock()
+	fd, ok := l.copies[ino]
+	l.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	// The magic link is resolved to the inode itself
+	err := unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd), unix.AT_FDCWD, dst, unix.AT_SYMLINK_FOLLOW)
+	if err != nil {
+		return false, &os.LinkError{Op: "link", Old: fmt.Sprintf("first copy of inode %d", ino.ino), New: dst, Err: err}
+	}
+
+	return true, nil
+}
+
+// add records dst as the first copy of ino
+func (l *Links) add(ino inode, dst string) error {
+	if l == nil {
+		return nil
+	}
+
+	fd, err := unix.Open(dst, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dst, Err: err}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if old, ok := l.copies[ino]; ok {
+		unix.Close(old)
+	}
+
+	l.copies[ino] = fd
+	return nil
+}
+
+// Close releases the first copies
+func (l *Links) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ino, fd := range l.copies {
+		unix.Close(fd)
+		delete(l.copies, ino)
+	}
+
+	return nil
+}
+
+// multiLinked returns the inode of info if it has multiple links
+func multiLinked(info os.FileInfo) (inode, bool) {
+	st := info.Sys().(*syscall.Stat_t)
+	if info.IsDir() || st.Nlink < 2 {
+		return inode{}, false
+	}
+
+	return inode{uint64(st.Dev), st.Ino}, true
+}
+
+// Tree copies src to dst, which must not exist. src may be a directory,
+// in which case it's copied recursively, or any other type of dirent.
+// Symlinks are not followed.
+func Tree(src, dst string) error {
+	return (&Copier{}).Tree(src, dst)
+}
+
+// Tree is like the package function Tree. If the copy is stopped,
+// ErrInterrupted is returned and dst is left incomplete.
+func (cp *Copier) Tree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		ino, isMultiLinked := multiLinked(info)
+
+		if isMultiLinked {
+			if linked, err := cp.Links.link(ino, dst); err != nil || linked {
+				if linked {
+					cp.progress(info)
+				}
+				return err
+			}
+		}
+
+		if cp.stopped() {
+			return ErrInterrupted
+		}
+
+		if err = copyDirent(src, dst, info, cp.Stop); err != nil {
+			return err
+		}
+
+		cp.progress(info)
+
+		if isMultiLinked {
+			return cp.Links.add(ino, dst)
+		}
+		return nil
+	}
+
+	c := newTreeCopier(cp)
+	c.walk(src, dst, info)
+
+	return c.wait()
+}
+
+func (cp *Copier) progress(info os.FileInfo) {
+	if cp.Progress == nil {
+		return
+	}
+
+	var bytes int64
+	if info.Mode().IsRegular() {
+		bytes = info.Size()
+	}
+
+	cp.Progress(1, bytes)
+}
+
+func (cp *Copier) stopped() bool {
+	return isStopped(cp.Stop)
+}
+
+type treeCopier struct {
+	*Copier
+
+	jobs chan fileJob
+	wg   sync.WaitGroup
+
+	errMu sync.Mutex
+	err   error
+
+	// Attributes of directories are set only once their contents are copied
+	dirs []fileJob
+
+	// Destinations of the first copies of inodes with multiple links,
+	// the other links to them are created once the first copies are done
+	copied map[inode]string
+	links  []hardlink
+
+	// The root of the copy
+	dst *os.File
+}
+
+func newTreeCopier(cp *Copier) *treeCopier {
+	c := &treeCopier{
+		Copier: cp,
+		jobs:   make(chan fileJob, Workers),
+		copied: make(map[inode]string),
+	}
+
+	c.wg.Add(Workers)
+	for i := 0; i < Workers; i++ {
+		go c.worker()
+	}
+
+	return c
+}
+
+func (c *treeCopier) worker() {
+	defer c.wg.Done()
+
+	for job := range c.jobs {
+		if c.failed() {
+			continue
+		}
+
+		if err := copyDirent(job.src, job.dst, job.info, nil); err != nil {
+			c.setErr(err)
+		} else {
+			c.progress(job.info)
+		}
+	}
+}
+
+func (c *treeCopier) setErr(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+}
+
+func (c *treeCopier) failed() bool {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err != nil
+}
+
+// walk creates the directory structure and hands regular files over to the workers
+func (c *treeCopier) walk(src, dst string, info os.FileInfo) {
+	defer close(c.jobs)
+
+	if err := os.Mkdir(dst, 0700); err != nil {
+		c.setErr(err)
+		return
+	}
+
+	c.dirs = append(c.dirs, fileJob{src, dst, info})
+	c.progress(info)
+
+	// The contents are created through the opened directory,
+	// even if it's renamed or replaced by a symlink in the meantime
+	d, err := os.OpenFile(dst, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		c.setErr(err)
+		return
+	}
+
+	c.dst = d
+	dstBase := beneath.FdPath(d)
+
+	iter, err := diriter.NewRecursiveIter(src)
+	if err != nil {
+		c.setErr(err)
+		return
+	}
+	defer iter.Close()
+
+	for !iter.AtEnd() && !c.failed() {
+		if c.stopped() {
+			c.setErr(ErrInterrupted)
+			return
+		}
+
+		var (
+			info    = iter.FileInfo()
+			relPath = path.Join(iter.Base(), info.Name())[len(src):]
+			job     = fileJob{src + relPath, dstBase + relPath, info}
+		)
+
+		linked, err := c.isLinked(job)
+		if err != nil {
+			c.setErr(err)
+			return
+		}
+
+		switch {
+		case linked:
+			// Another link to the inode has been copied already
+			c.progress(info)
+		case info.IsDir():
+			if err = os.Mkdir(job.dst, 0700); err != nil {
+				c.setErr(err)
+				return
+			}
+
+			c.dirs = append(c.dirs, job)
+			c.progress(info)
+		case info.Mode().IsRegular():
+			c.jobs <- job
+		default:
+			if err = copyDirent(job.src, job.dst, info, nil); err != nil {
+				c.setErr(err)
+				return
+			}
+
+			c.progress(info)
+		}
+
+		if iter.Increment(); iter.Err() != nil {
+			c.setErr(iter.Err())
+			return
+		}
+	}
+}
+
+// isLinked checks whether the dirent is a hardlink to an inode that's been
+// copied already. If so, the link is recreated once the copy is done,
+// or right away if it's been copied by an earlier copy sharing Links.
+func (c *treeCopier) isLinked(job fileJob) (bool, error) {
+	ino, ok := multiLinked(job.info)
+	if !ok {
+		return false, nil
+	}
+
+	if first, ok := c.copied[ino]; ok {
+		c.links = append(c.links, hardlink{first, job.dst})
+		return true, nil
+	}
+
+	if linked, err := c.Links.link(ino, job.dst); err != nil || linked {
+		return linked, err
+	}
+
+	c.copied[ino] = job.dst
+	return false, nil
+}
+
+func (c *treeCopier) wait() error {
+	c.wg.Wait()
+
+	if c.dst != nil {
+		defer c.dst.Close()
+	}
+
+	if c.err != nil {
+		return c.err
+	}
+
+	for _, l := range c.links {
+		if err := os.Link(l.oldname, l.newname); err != nil {
+			return err
+		}
+	}
+
+	for ino, dst := range c.copied {
+		if err := c.Links.add(ino, dst); err != nil {
+			return err
+		}
+	}
+
+	// Creating the contents has changed the timestamps, so the attributes
+	// are set only now. Children first, as a parent may be read-only.
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		if err := copyAttrs(c.dirs[i].src, c.dirs[i].dst, c.dirs[i].info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
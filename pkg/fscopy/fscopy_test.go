@@ -0,0 +1,636 @@
+package fscopy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "fscopy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func mustWriteFile(t *testing.T, p, data string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustCopy(t *testing.T, src, dst string) {
+	t.Helper()
+
+	if err := Tree(src, dst); err != nil {
+		t.Fatalf("copy %s to %s: %v", src, dst, err)
+	}
+}
+
+func lstat(t *testing.T, p string) os.FileInfo {
+	t.Helper()
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info
+}
+
+// checkAttrs compares the type, permissions, ownership and mtime of src and dst
+func checkAttrs(t *testing.T, src, dst string) {
+	t.Helper()
+
+	var (
+		srcInfo = lstat(t, src)
+		dstInfo = lstat(t, dst)
+		srcSt   = srcInfo.Sys().(*syscall.Stat_t)
+		dstSt   = dstInfo.Sys().(*syscall.Stat_t)
+	)
+
+	if srcInfo.Mode() != dstInfo.Mode() {
+		t.Errorf("%s: mode %v, expected %v", dst, dstInfo.Mode(), srcInfo.Mode())
+	}
+
+	if srcSt.Uid != dstSt.Uid || srcSt.Gid != dstSt.Gid {
+		t.Errorf("%s: owner %d:%d, expected %d:%d", dst, dstSt.Uid, dstSt.Gid, srcSt.Uid, srcSt.Gid)
+	}
+
+	if !srcInfo.ModTime().Equal(dstInfo.ModTime()) {
+		t.Errorf("%s: mtime %v, expected %v", dst, dstInfo.ModTime(), srcInfo.ModTime())
+	}
+}
+
+func checkContents(t *testing.T, src, dst string) {
+	t.Helper()
+
+	want, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: contents differ from %s", dst, src)
+	}
+}
+
+type segment struct {
+	data, hole int64
+}
+
+// dataSegments lists the data segments of p as reported by SEEK_DATA and SEEK_HOLE
+func dataSegments(t *testing.T, p string) []segment {
+	t.Helper()
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var segs []segment
+
+	for off := int64(0); off < info.Size(); {
+		data, err := unix.Seek(int(f.Fd()), off, seekData)
+		if err == unix.ENXIO {
+			break
+		}
+		if err != nil {
+			t.Skipf("SEEK_DATA: %v", err)
+		}
+
+		hole, err := unix.Seek(int(f.Fd()), data, seekHole)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segs = append(segs, segment{data, hole})
+		off = hole
+	}
+
+	return segs
+}
+
+func TestTreeRegularFiles(t *testing.T) {
+	var (
+		tmp   = tempDir(t)
+		src   = path.Join(tmp, "src")
+		dst   = path.Join(tmp, "dst")
+		mtime = time.Unix(1500000000, 123456789)
+	)
+
+	if err := os.MkdirAll(path.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteFile(t, path.Join(src, "f"), "foo")
+	mustWriteFile(t, path.Join(src, "sub", "g"), "bar")
+
+	if err := os.Chmod(path.Join(src, "sub", "g"), 0640|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(path.Join(src, "sub"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(path.Join(src, "sub"), 0755)
+
+	for _, p := range []string{"f", "sub/g", "sub", "."} {
+		if err := os.Chtimes(path.Join(src, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustCopy(t, src, dst)
+	defer os.Chmod(path.Join(dst, "sub"), 0755)
+
+	for _, p := range []string{"f", "sub/g", "sub", "."} {
+		checkAttrs(t, path.Join(src, p), path.Join(dst, p))
+	}
+
+	checkContents(t, path.Join(src, "f"), path.Join(dst, "f"))
+	checkContents(t, path.Join(src, "sub", "g"), path.Join(dst, "sub", "g"))
+}
+
+func TestTreeSparseFile(t *testing.T) {
+	var (
+		tmp   = tempDir(t)
+		src   = path.Join(tmp, "src")
+		dst   = path.Join(tmp, "dst")
+		block = bytes.Repeat([]byte{'x'}, 64<<10)
+	)
+
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// data, hole, data, hole at the end
+	_, err = f.WriteAt(block, 0)
+	if err == nil {
+		_, err = f.WriteAt(block, 1<<20)
+	}
+	if err == nil {
+		err = f.Truncate(3 << 20)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srcSegs := dataSegments(t, src)
+	if len(srcSegs) != 2 {
+		t.Skipf("filesystem doesn't report the holes of %s: %v", src, srcSegs)
+	}
+
+	mustCopy(t, src, dst)
+
+	checkContents(t, src, dst)
+
+	if dstSegs := dataSegments(t, dst); len(dstSegs) != len(srcSegs) {
+		t.Errorf("data segments %v, expected %v", dstSegs, srcSegs)
+	} else {
+		for i := range srcSegs {
+			if dstSegs[i] != srcSegs[i] {
+				t.Errorf("data segments %v, expected %v", dstSegs, srcSegs)
+				break
+			}
+		}
+	}
+
+	if info := lstat(t, dst); info.Size() != 3<<20 {
+		t.Errorf("size %d, expected %d", info.Size(), 3<<20)
+	}
+}
+
+func TestTreeHardlinks(t *testing.T) {
+	var (
+		tmp = tempDir(t)
+		src = path.Join(tmp, "src")
+		dst = path.Join(tmp, "dst")
+	)
+
+	if err := os.MkdirAll(path.Join(src, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteFile(t, path.Join(src, "f"), "foo")
+
+	for _, p := range []string{"a/f", "a/b/f"} {
+		if err := os.Link(path.Join(src, "f"), path.Join(src, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustWriteFile(t, path.Join(src, "single"), "bar")
+
+	mustCopy(t, src, dst)
+
+	first := lstat(t, path.Join(dst, "f"))
+
+	for _, p := range []string{"a/f", "a/b/f"} {
+		if !os.SameFile(first, lstat(t, path.Join(dst, p))) {
+			t.Errorf("%s isn't linked to f", p)
+		}
+	}
+
+	if n := first.Sys().(*syscall.Stat_t).Nlink; n != 3 {
+		t.Errorf("f has %d links, expected 3", n)
+	}
+
+	if os.SameFile(first, lstat(t, path.Join(src, "f"))) {
+		t.Error("f is linked to the source")
+	}
+}
+
+// Links shared by multiple copies keep the links across them,
+// even after the first copy has been moved
+func TestTreeSharedLinks(t *testing.T) {
+	var (
+		tmp   = tempDir(t)
+		src   = path.Join(tmp, "src")
+		dst   = path.Join(tmp, "dst")
+		links = NewLinks()
+	)
+	defer links.Close()
+
+	if err := os.MkdirAll(path.Join(src, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(path.Join(src, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteFile(t, path.Join(src, "a", "f"), "foo")
+
+	for _, p := range []string{"b/f", "g"} {
+		if err := os.Link(path.Join(src, "a", "f"), path.Join(src, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp := &Copier{Links: links}
+	copyShared := func(src, dst string) {
+		t.Helper()
+
+		if err := cp.Tree(src, dst); err != nil {
+			t.Fatalf("copy %s to %s: %v", src, dst, err)
+		}
+	}
+
+	copyShared(path.Join(src, "a"), path.Join(dst, "a.new"))
+
+	if err := os.Rename(path.Join(dst, "a.new"), path.Join(dst, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	copyShared(path.Join(src, "b"), path.Join(dst, "b"))
+	copyShared(path.Join(src, "g"), path.Join(dst, "g"))
+
+	first := lstat(t, path.Join(dst, "a", "f"))
+
+	for _, p := range []string{"b/f", "g"} {
+		if !os.SameFile(first, lstat(t, path.Join(dst, p))) {
+			t.Errorf("%s isn't linked to a/f", p)
+		}
+	}
+
+	// Without shared links, each copy has its own inode
+	mustCopy(t, path.Join(src, "g"), path.Join(dst, "h"))
+
+	if os.SameFile(first, lstat(t, path.Join(dst, "h"))) {
+		t.Error("h is linked to a/f without shared links")
+	}
+}
+
+func TestTreeXattrs(t *testing.T) {
+	var (
+		tmp = tempDir(t)
+		src = path.Join(tmp, "src")
+		dst = path.Join(tmp, "dst")
+		acl = posixACL(
+			aclEntry{tag: 0x01, perm: 6},            // user::rw-
+			aclEntry{tag: 0x02, perm: 4, id: 12345}, // user:12345:r--
+			aclEntry{tag: 0x04, perm: 4},            // group::r--
+			aclEntry{tag: 0x10, perm: 4},            // mask::r--
+			aclEntry{tag: 0x20, perm: 0},            // other::---
+		)
+	)
+
+	mustWriteFile(t, src, "foo")
+
+	if err := unix.Lsetxattr(src, "user.eph-test", []byte("value"), 0); err != nil {
+		t.Skipf("user xattrs unsupported: %v", err)
+	}
+
+	hasACL := unix.Lsetxattr(src, "system.posix_acl_access", acl, 0) == nil
+	hasOverlay := unix.Lsetxattr(src, "trusted.overlay.opaque", []byte("y"), 0) == nil
+
+	mustCopy(t, src, dst)
+
+	if v, err := getXattr(dst, "user.eph-test"); err != nil || string(v) != "value" {
+		t.Errorf("user.eph-test = %q, %v, expected %q", v, err, "value")
+	}
+
+	if hasACL {
+		if v, err := getXattr(dst, "system.posix_acl_access"); err != nil || !bytes.Equal(v, acl) {
+			t.Errorf("system.posix_acl_access = %x, %v, expected %x", v, err, acl)
+		}
+	}
+
+	if hasOverlay {
+		if _, err := getXattr(dst, "trusted.overlay.opaque"); err != unix.ENODATA {
+			t.Errorf("trusted.overlay.opaque has been copied: %v", err)
+		}
+	}
+
+	checkAttrs(t, src, dst)
+}
+
+type aclEntry struct {
+	tag, perm uint16
+	id        uint32
+}
+
+// posixACL encodes an ACL the way system.posix_acl_access stores it
+func posixACL(entries ...aclEntry) []byte {
+	const aclVersion = 2
+
+	b := make([]byte, 4, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(b, aclVersion)
+
+	for _, e := range entries {
+		id := e.id
+		if e.tag != 0x02 && e.tag != 0x08 {
+			// Undefined for entries other than named users and groups
+			id = 0xffffffff
+		}
+
+		var ent [8]byte
+		binary.LittleEndian.PutUint16(ent[0:], e.tag)
+		binary.LittleEndian.PutUint16(ent[2:], e.perm)
+		binary.LittleEndian.PutUint32(ent[4:], id)
+		b = append(b, ent[:]...)
+	}
+
+	return b
+}
+
+func TestTreeSpecialFiles(t *testing.T) {
+	var (
+		tmp = tempDir(t)
+		src = path.Join(tmp, "src")
+		dst = path.Join(tmp, "dst")
+	)
+
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Mkfifo(path.Join(src, "fifo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"fifo"}
+
+	if os.Geteuid() == 0 {
+		// /dev/null
+		if err := unix.Mknod(path.Join(src, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, "null")
+	} else {
+		t.Log("not root, device nodes aren't tested")
+	}
+
+	mustCopy(t, src, dst)
+
+	for _, name := range names {
+		checkAttrs(t, path.Join(src, name), path.Join(dst, name))
+	}
+
+	if os.Geteuid() == 0 {
+		st := lstat(t, path.Join(dst, "null")).Sys().(*syscall.Stat_t)
+		if st.Rdev != unix.Mkdev(1, 3) {
+			t.Errorf("null: device %d:%d, expected 1:3", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+		}
+	}
+}
+
+func TestTreeSymlinks(t *testing.T) {
+	var (
+		tmp   = tempDir(t)
+		src   = path.Join(tmp, "src")
+		dst   = path.Join(tmp, "dst")
+		atime = time.Unix(1400000000, 987654321)
+		mtime = time.Unix(1500000000, 123456789)
+	)
+
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteFile(t, path.Join(src, "f"), "foo")
+
+	for name, target := range map[string]string{"rel": "f", "dangling": "../nowhere", "abs": "/"} {
+		p := path.Join(src, name)
+
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+
+		ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustCopy(t, src, dst)
+
+	for name, target := range map[string]string{"rel": "f", "dangling": "../nowhere", "abs": "/"} {
+		p := path.Join(dst, name)
+
+		// Before reading the link, which updates its atime
+		st := lstat(t, p).Sys().(*syscall.Stat_t)
+		if got := time.Unix(st.Atim.Unix()); !got.Equal(atime) {
+			t.Errorf("%s: atime %v, expected %v", name, got, atime)
+		}
+
+		if got := time.Unix(st.Mtim.Unix()); !got.Equal(mtime) {
+			t.Errorf("%s: mtime %v, expected %v", name, got, mtime)
+		}
+
+		if got, err := os.Readlink(p); err != nil || got != target {
+			t.Errorf("%s: target %q, %v, expected %q", name, got, err, target)
+		}
+	}
+
+	// The target's timestamps are left alone
+	checkAttrs(t, path.Join(src, "f"), path.Join(dst, "f"))
+}
+
+// Contents are copied with read/write when neither FICLONE
+// nor copy_file_range can be used for the files
+func TestCopyContentsFallback(t *testing.T) {
+	var (
+		tmp = tempDir(t)
+		dst = path.Join(tmp, "dst")
+	)
+
+	// FICLONE and copy_file_range fail across filesystems of different types
+	src := "/proc/self/cmdline"
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer in.Close()
+
+	want, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = copyContents(in, out, info.Sys().(*syscall.Stat_t), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("copied %q, expected %q", got, want)
+	}
+}
+
+func TestCopyRangeOffset(t *testing.T) {
+	var (
+		tmp = tempDir(t)
+		src = path.Join(tmp, "src")
+		dst = path.Join(tmp, "dst")
+	)
+
+	mustWriteFile(t, src, "0123456789")
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	for _, copy := range []func(in, out *os.File, off, length int64, stop <-chan struct{}) error{copyRange, readWriteRange} {
+		out, err := os.Create(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = copy(in, out, 2, 3, nil)
+		if err == nil {
+			err = copy(in, out, 7, -1, nil)
+		}
+		out.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, _ := ioutil.ReadFile(dst); string(got) != "\x00\x00234\x00\x00789" {
+			t.Errorf("copied %q", got)
+		}
+	}
+}
+
+func TestCopyStopped(t *testing.T) {
+	var (
+		tmp  = tempDir(t)
+		src  = path.Join(tmp, "src")
+		stop = make(chan struct{})
+	)
+
+	mustWriteFile(t, src, "0123456789")
+	close(stop)
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	for i, copy := range []func(in, out *os.File, off, length int64, stop <-chan struct{}) error{copyRange, readWriteRange} {
+		out, err := os.Create(path.Join(tmp, "range"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = copy(in, out, 0, -1, stop)
+		out.Close()
+
+		if err != ErrInterrupted {
+			t.Errorf("copy range %d: %v, expected %v", i, err, ErrInterrupted)
+		}
+	}
+
+	cp := &Copier{Stop: stop}
+	if err = cp.Tree(src, path.Join(tmp, "tree")); err != ErrInterrupted {
+		t.Errorf("single file copy: %v, expected %v", err, ErrInterrupted)
+	}
+}
+
+func TestIsCopyUnsupported(t *testing.T) {
+	for _, err := range []error{unix.ENOSYS, unix.EXDEV, unix.EOPNOTSUPP, unix.EINVAL, unix.EBADF} {
+		if !isCopyUnsupported(err) {
+			t.Errorf("%v should fall back to read/write", err)
+		}
+	}
+
+	for _, err := range []error{unix.EIO, unix.ENOSPC} {
+		if isCopyUnsupported(err) {
+			t.Errorf("%v shouldn't fall back to read/write", err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package ignore matches paths against gitignore-style patterns.
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Patterns are added with --ignore, after the ones read from files
+	Patterns []string
+	// Gitignore makes .gitignore be used when there's no .ephignore.
+	// Set with --gitignore.
+	Gitignore bool
+)
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher decides which paths are ignored. The last pattern matching
+// a path wins, patterns starting with ! re-include paths ignored by
+// the preceding ones. A nil Matcher doesn't ignore anything.
+type Matcher struct {
+	rules []rule
+}
+
+// New parses patterns in the gitignore format:
+//
+//   - blank lines and lines starting with # are skipped
+//   - a pattern ending with / matches only directories
+//   - a pattern containing / elsewhere is relative to the root,
+//     others match names at any level
+//   - * and ? match anything but /, [...] matches a class of characters
+//   - ** matches any number of directories
+//   - \ escapes the character following it
+func New(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+
+	for _, p := range patterns {
+		if err := m.add(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(m.rules) == 0 {
+		return nil, nil
+	}
+
+	return m, nil
+}
+
+// Read reads patterns from r, one per line
+func Read(r io.Reader) ([]string, error) {
+	var (
+		patterns []string
+		s        = bufio.NewScanner(r)
+	)
+
+	for s.Scan() {
+		patterns = append(patterns, s.Text())
+	}
+
+	return patterns, s.Err()
+}
+
+func (m *Matcher) add(pattern string) error {
+	pattern = strings.TrimSuffix(pattern, "\r")
+	pattern = trimTrailingSpaces(pattern)
+
+	if pattern == "" || pattern[0] == '#' {
+		return nil
+	}
+
+	var r rule
+
+	if pattern[0] == '!' {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	if pattern == "" {
+		return nil
+	}
+
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr := translate(pattern)
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return fmt.Errorf("invalid ignore pattern %s: %v", pattern, err)
+	}
+
+	r.re = re
+	m.rules = append(m.rules, r)
+
+	return nil
+}
+
+// trimTrailingSpaces removes trailing spaces that aren't escaped
+func trimTrailingSpaces(s string) string {
+	for strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\\ ") {
+		s = s[:len(s)-1]
+	}
+
+	return s
+}
+
+// translate turns a glob pattern into a regular expression
+func translate(pattern string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			// Any number of directories, including none
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case pattern[i:] == "**" && i > 0 && pattern[i-1] == '/':
+			// Everything inside
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// Match reports whether relPath, a path relative to the root without
+// a leading slash, is ignored by the patterns. Its parent directories
+// are expected to have been checked already, see MatchParents.
+func (m *Matcher) Match(relPath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	ignored := false
+
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+
+		if r.re.MatchString(relPath) {
+			ignored = !r.negate
+		}
+	}
+
+	return ignored
+}
+
+// MatchParents reports whether any of the directories relPath is in
+// is ignored, along with everything inside of it
+func (m *Matcher) MatchParents(relPath string) bool {
+	if m == nil {
+		return false
+	}
+
+	for i := 0; i < len(relPath); i++ {
+		if relPath[i] == '/' && m.Match(relPath[:i], true) {
+			return true
+		}
+	}
+
+	return false
+}
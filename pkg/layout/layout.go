@@ -2,12 +2,19 @@ package layout
 
 import (
 	"fmt"
+	"net/url"
 	"path"
+	"strings"
 )
 
 const (
-	fmtBase = ".eph.%s"
-	fmtOrig = "%s/orig"
+	fmtBase    = ".eph.%s"
+	fmtBackups = ".eph-backup.%s"
+	fmtOrig    = "%s/orig"
+
+	fmtMergeJournal   = "%s/merge.journal"
+	fmtSourceManifest = "%s/source.manifest"
+	fmtLock           = "%s/lock"
 
 	fmtStaging        = "%s/staging"
 	fmtOverlayHead    = "%s/staging/head"
@@ -21,6 +28,10 @@ const (
 
 var (
 	BaseOverride string
+
+	// Registry lists the eph roots on this host, so that they can be
+	// found once their ramdisks are gone, e.g. after a reboot
+	Registry = "/var/lib/eph/roots"
 )
 
 func fmtPath(format, p string) string {
@@ -34,8 +45,23 @@ func Base(p string) string {
 	return path.Join(path.Dir(p), fmt.Sprintf(fmtBase, path.Base(p)))
 }
 
+// Backups holds merge backups. Unlike eph root, it's not removed
+// once the ramdisk is merged, and it's not affected by BaseOverride.
+func Backups(p string) string {
+	return path.Join(path.Dir(p), fmt.Sprintf(fmtBackups, path.Base(p)))
+}
+
+// BackupsLock keeps concurrent undo-merges off the backups of p
+func BackupsLock(p string) string { return path.Join(Backups(p), "lock") }
+
 func Orig(p string) string { return fmtPath(fmtOrig, p) }
 
+func MergeJournal(p string) string { return fmtPath(fmtMergeJournal, p) }
+
+func SourceManifest(p string) string { return fmtPath(fmtSourceManifest, p) }
+
+func Lock(p string) string { return fmtPath(fmtLock, p) }
+
 func Staging(p string) string { return fmtPath(fmtStaging, p) }
 
 func Head(p string) string { return fmtPath(fmtOverlayHead, p) }
@@ -49,3 +75,63 @@ func Snapshots(p string) string { return fmtPath(fmtSnapshots, p) }
 func SnapshotsState(p string) string { return fmtPath(fmtSnapshotsState, p) }
 
 func SnapshotMounts(p string) string { return fmtPath(fmtSnapshotMounts, p) }
+
+// The following take eph root base instead of the target location,
+// for ramdisks found by their eph roots rather than by their targets
+
+func OrigIn(base string) string { return fmt.Sprintf(fmtOrig, base) }
+
+func SourceManifestIn(base string) string { return fmt.Sprintf(fmtSourceManifest, base) }
+
+func LockIn(base string) string { return fmt.Sprintf(fmtLock, base) }
+
+func StagingIn(base string) string { return fmt.Sprintf(fmtStaging, base) }
+
+func HeadIn(base string) string { return fmt.Sprintf(fmtOverlayHead, base) }
+
+func MergeJournalIn(base string) string { return fmt.Sprintf(fmtMergeJournal, base) }
+
+func SnapshotsStateIn(base string) string { return fmt.Sprintf(fmtSnapshotsState, base) }
+
+func SnapshotMountsIn(base string) string { return fmt.Sprintf(fmtSnapshotMounts, base) }
+
+// BaseOfOverlayDiff returns the eph root whose overlay upper layer is diff,
+// false is returned if diff isn't one
+func BaseOfOverlayDiff(diff string) (string, bool) { return baseOf(fmtOverlayDiff, diff) }
+
+// BaseOfStaging returns the eph root whose ramdisk is mounted at staging,
+// false is returned if staging isn't one
+func BaseOfStaging(staging string) (string, bool) { return baseOf(fmtStaging, staging) }
+
+func baseOf(format, p string) (string, bool) {
+	suffix := strings.TrimPrefix(format, "%s")
+	if !strings.HasSuffix(p, suffix) || len(p) == len(suffix) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(p, suffix), true
+}
+
+// TargetOf guesses the target location of eph root base from its name.
+// An empty string is returned for eph roots set with --eph-root.
+func TargetOf(base string) string {
+	prefix := strings.TrimSuffix(fmtBase, "%s")
+
+	name := path.Base(base)
+	if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+		return ""
+	}
+
+	return path.Join(path.Dir(base), name[len(prefix):])
+}
+
+// RegistryEntry is a symlink in Registry named after eph root base,
+// pointing to the target location of its ramdisk
+func RegistryEntry(base string) string {
+	return path.Join(Registry, url.PathEscape(base))
+}
+
+// BaseOfRegistryEntry returns the eph root registered under name
+func BaseOfRegistryEntry(name string) (string, error) {
+	return url.PathUnescape(name)
+}
@@ -9,3 +9,20 @@ func SnapshotFilename(snapId int) string {
 func SnapshotMountpointTarget(snapId int) string {
 	return fmt.Sprintf("snap-%d.mount", snapId)
 }
+
+func MergeStagedName(opIdx int) string {
+	return fmt.Sprintf(".eph-merge.%d.new", opIdx)
+}
+
+func MergeOldName(opIdx int) string {
+	return fmt.Sprintf(".eph-merge.%d.old", opIdx)
+}
+
+func MergeBackupName(backupId int) string {
+	return fmt.Sprintf("merge-%d", backupId)
+}
+
+func MergeBackupId(name string) (backupId int, err error) {
+	_, err = fmt.Sscanf(name, "merge-%d", &backupId)
+	return
+}
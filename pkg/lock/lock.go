@@ -0,0 +1,220 @@
+package lock
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// Wait makes Acquire wait for the lock to be released
+	// instead of failing when another process holds it
+	Wait bool
+	// Timeout limits how long Acquire waits for the lock, implies Wait
+	Timeout time.Duration
+)
+
+type Mode int
+
+const (
+	Shared    Mode = syscall.LOCK_SH
+	Exclusive Mode = syscall.LOCK_EX
+)
+
+// How often a lock is retried when waiting with a timeout
+const pollInterval = 100 * time.Millisecond
+
+// Lock is an flock(2) on a lock file
+type Lock struct {
+	f *os.File
+}
+
+// HeldError is returned by Acquire when the lock is held by another process
+type HeldError struct {
+	// Holder describes the processes holding the lock
+	Holder string
+	// TimedOut is set if Acquire has waited for the lock in vain
+	TimedOut bool
+}
+
+func (e *HeldError) Error() string {
+	if e.TimedOut {
+		return fmt.Sprintf("timed out waiting for %s", e.Holder)
+	}
+	return fmt.Sprintf("locked by %s", e.Holder)
+}
+
+// Acquire locks the file at p, creating it if needed. If another process
+// holds the lock, a *HeldError is returned unless Wait or Timeout is set,
+// in which case waiting is called with the holder and the lock is retried.
+// A lock file that's removed while waiting isn't recreated,
+// an os.IsNotExist error is returned instead.
+func Acquire(p string, mode Mode, waiting func(holder string)) (*Lock, error) {
+	var deadline time.Time
+	if Timeout > 0 {
+		deadline = time.Now().Add(Timeout)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), int(mode)|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = wait(f, mode, deadline, waiting)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// The file may have been removed along with its directory
+	// by the process that held the lock
+	if removed, err := isRemoved(p, f); err != nil || removed {
+		f.Close()
+		if err == nil {
+			err = &os.PathError{Op: "lock", Path: p, Err: syscall.ENOENT}
+		}
+		return nil, err
+	}
+
+	return &Lock{f: f}, nil
+}
+
+func wait(f *os.File, mode Mode, deadline time.Time, waiting func(holder string)) error {
+	if !Wait && Timeout == 0 {
+		return &HeldError{Holder: holderOf(f)}
+	}
+
+	if waiting != nil {
+		waiting(holderOf(f))
+	}
+
+	if deadline.IsZero() {
+		for {
+			err := syscall.Flock(int(f.Fd()), int(mode))
+			if err != syscall.EINTR {
+				return err
+			}
+		}
+	}
+
+	for time.Now().Before(deadline) {
+		time.Sleep(pollInterval)
+
+		err := syscall.Flock(int(f.Fd()), int(mode)|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+	}
+
+	return &HeldError{Holder: holderOf(f), TimedOut: true}
+}
+
+func isRemoved(p string, f *os.File) (bool, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	fInfo, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(info, fInfo), nil
+}
+
+// Release unlocks the lock. It's safe to release a lock more than once.
+func (l *Lock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
+
+// holderOf describes the processes holding a lock on f, see holders
+func holderOf(f *os.File) string {
+	pids := holders(f)
+
+	if len(pids) == 0 {
+		// Released in the meantime, or /proc/locks is unavailable
+		return "another process"
+	}
+
+	descs := make([]string, len(pids))
+
+	for i, pid := range pids {
+		descs[i] = fmt.Sprintf("PID %d", pid)
+
+		if cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+			descs[i] += fmt.Sprintf(" (%s)", strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1)))
+		}
+	}
+
+	return strings.Join(descs, ", ")
+}
+
+// holders lists the PIDs of the processes holding a lock on f in /proc/locks,
+// whose lines look like this:
+//
+//	1: FLOCK  ADVISORY  WRITE 1234 08:01:5678 0 EOF
+//	1: -> FLOCK  ADVISORY  WRITE 4321 08:01:5678 0 EOF
+//
+// The second line is a process waiting for the lock.
+func holders(f *os.File) []int {
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+
+	st := info.Sys().(*syscall.Stat_t)
+	fileId := fmt.Sprintf("%02x:%02x:%d", major(uint64(st.Dev)), minor(uint64(st.Dev)), st.Ino)
+
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return nil
+	}
+	defer locks.Close()
+
+	var (
+		pids []int
+		self = os.Getpid()
+		s    = bufio.NewScanner(locks)
+	)
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != fileId {
+			continue
+		}
+
+		if pid, err := strconv.Atoi(fields[4]); err == nil && pid != self {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids
+}
+
+func major(dev uint64) uint64 {
+	return (dev>>8)&0xfff | (dev>>32)&^0xfff
+}
+
+func minor(dev uint64) uint64 {
+	return dev&0xff | (dev>>12)&^0xff
+}
@@ -0,0 +1,150 @@
+// Package output writes the results of eph commands either for humans,
+// or in formats meant to be parsed by other programs.
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Text is the human-readable output, its format may change
+	Text = "text"
+	// Porcelain is a stable line-based format, one record per line
+	Porcelain = "porcelain"
+	// JSON writes a single JSON document
+	JSON = "json"
+)
+
+var (
+	// Format is the output format selected with --output
+	Format = Text
+	// NulTerminated terminates porcelain records with NUL bytes instead
+	// of newlines, and leaves the paths in them unquoted. Set with -z.
+	NulTerminated bool
+)
+
+// Check validates the selected output format. -z on its own selects
+// the porcelain format.
+func Check() error {
+	switch Format {
+	case Text, Porcelain, JSON:
+	default:
+		return fmt.Errorf("unknown output format %s, expected one of text, porcelain, json", Format)
+	}
+
+	if NulTerminated {
+		switch Format {
+		case Text:
+			Format = Porcelain
+		case JSON:
+			return errors.New("-z can't be used with JSON output")
+		}
+	}
+
+	return nil
+}
+
+// WriteJSON writes v into stdout as an indented JSON document
+func WriteJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// WriteJSONLine writes v into stdout as a single line of JSON,
+// so that a stream of documents can be parsed line by line
+func WriteJSONLine(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+
+	return enc.Encode(v)
+}
+
+// Writer writes porcelain records into stdout. Errors are reported by Flush.
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter() *Writer {
+	return &Writer{w: bufio.NewWriter(os.Stdout)}
+}
+
+// Record writes fields separated by spaces. Fields that may contain
+// spaces, like paths and labels, are expected to be the last ones,
+// or quoted with Quote.
+func (w *Writer) Record(fields ...string) {
+	w.w.WriteString(strings.Join(fields, " "))
+
+	if NulTerminated {
+		w.w.WriteByte(0)
+	} else {
+		w.w.WriteByte('\n')
+	}
+}
+
+// Rename writes a record of a dirent moved from one path to another. With -z,
+// the original path follows in a separate record, the same way git does it.
+func (w *Writer) Rename(code, from, to string) {
+	if NulTerminated {
+		w.Record(code, to)
+		w.Record(from)
+	} else {
+		w.Record(code, Quote(from), "->", Quote(to))
+	}
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Quote double-quotes s with Go escapes if it contains control characters,
+// quotes, backslashes, or invalid UTF-8, or if s would be ambiguous in a rename
+// record. It's returned as is with -z.
+func Quote(s string) string {
+	if NulTerminated {
+		return s
+	}
+
+	if !utf8.ValidString(s) || strings.Contains(s, " -> ") {
+		return strconv.Quote(s)
+	}
+
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f || r == '"' || r == '\\' {
+			return strconv.Quote(s)
+		}
+	}
+
+	return s
+}
+
+// FileType names the type of a file with the given mode
+func FileType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeCharDevice != 0:
+		return "char-device"
+	case mode&os.ModeDevice != 0:
+		return "block-device"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,160 @@
+// Package progress reports the progress of long running copies on a terminal.
+package progress
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"math/bits"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const refreshInterval = 500 * time.Millisecond
+
+// Reporter keeps track of the number of files and bytes done out of
+// the total, and periodically shows them on stderr along with
+// the throughput and the estimated time remaining.
+type Reporter struct {
+	// Accessed atomically
+	files int64
+	bytes int64
+
+	label      string
+	totalFiles int64
+	totalBytes int64
+	start      time.Time
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// New starts reporting progress towards totalFiles and totalBytes.
+// Either of them may be 0 if unknown. Nothing is shown unless
+// stderr is a terminal.
+func New(label string, totalFiles, totalBytes int64) *Reporter {
+	r := &Reporter{
+		label:      label,
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		start:      time.Now(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if isTerminal(os.Stderr) {
+		go r.show()
+	} else {
+		close(r.done)
+	}
+
+	return r
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// Add marks files and bytes as done. It's safe to be called concurrently.
+func (r *Reporter) Add(files int, bytes int64) {
+	atomic.AddInt64(&r.files, int64(files))
+	atomic.AddInt64(&r.bytes, bytes)
+}
+
+// Stop shows the final progress and stops reporting.
+func (r *Reporter) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+func (r *Reporter) show() {
+	defer close(r.done)
+
+	t := time.NewTicker(refreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			fmt.Fprintf(os.Stderr, "\r%s\x1b[K", r.line())
+		case <-r.stop:
+			fmt.Fprintf(os.Stderr, "\r%s\x1b[K\n", r.line())
+			return
+		}
+	}
+}
+
+func (r *Reporter) line() string {
+	var (
+		files   = atomic.LoadInt64(&r.files)
+		bytes   = atomic.LoadInt64(&r.bytes)
+		elapsed = time.Since(r.start)
+		rate    = float64(bytes) / elapsed.Seconds()
+	)
+
+	s := fmt.Sprintf("%s: %s files, %s", r.label, ofTotal(files, r.totalFiles, fmtCount), ofTotal(bytes, r.totalBytes, fmtBytes))
+	s += fmt.Sprintf(", %s/s", fmtBytes(int64(rate)))
+
+	if eta, ok := r.eta(files, bytes, elapsed); ok {
+		s += ", ETA " + fmtDuration(eta)
+	}
+
+	return s
+}
+
+// eta estimates the remaining time from the average throughput so far.
+// Bytes are preferred over files as they vary much less in cost.
+func (r *Reporter) eta(files, bytes int64, elapsed time.Duration) (time.Duration, bool) {
+	var done, total int64
+
+	switch {
+	case r.totalBytes > 0 && bytes > 0:
+		done, total = bytes, r.totalBytes
+	case r.totalFiles > 0 && files > 0:
+		done, total = files, r.totalFiles
+	default:
+		return 0, false
+	}
+
+	if done >= total {
+		return 0, true
+	}
+
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done)), true
+}
+
+func ofTotal(n, total int64, format func(int64) string) string {
+	if total <= 0 {
+		return format(n)
+	}
+
+	return format(n) + "/" + format(total)
+}
+
+func fmtCount(n int64) string {
+	return fmt.Sprintf("%d", n)
+}
+
+func fmtBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	base := uint(bits.Len64(uint64(n)) / 10)
+	val := float64(n) / float64(uint64(1<<(base*10)))
+
+	return fmt.Sprintf("%.1f %ciB", val, " KMGTPE"[base])
+}
+
+func fmtDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
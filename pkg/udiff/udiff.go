@@ -0,0 +1,353 @@
+// Package udiff produces line-based diffs in the unified format.
+package udiff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Context is the number of unchanged lines shown around each change
+const Context = 3
+
+// MaxEdits limits the number of changed lines a diff is searched for.
+// The search takes time proportional to it times the number of lines.
+// Lines added or deleted all in one place are found without searching.
+var MaxEdits = 10000
+
+// ErrTooManyChanges is returned by Write when more than MaxEdits lines
+// would have to be changed
+var ErrTooManyChanges = errors.New("too many changes")
+
+type editKind byte
+
+const (
+	editEqual  editKind = ' '
+	editDelete editKind = '-'
+	editInsert editKind = '+'
+)
+
+type edit struct {
+	kind editKind
+	// Indices of the line in a and b, only the one that applies is valid
+	a, b int
+}
+
+// Lines splits data into lines, each of them keeping its trailing newline
+func Lines(data []byte) [][]byte {
+	var lines [][]byte
+
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, data)
+			break
+		}
+
+		lines = append(lines, data[:i+1])
+		data = data[i+1:]
+	}
+
+	return lines
+}
+
+// Write writes the unified diff of lines a and b, as returned by Lines,
+// into w. Nothing is written if they are the same, or if they differ
+// too much, in which case ErrTooManyChanges is returned.
+func Write(w io.Writer, aName, bName string, a, b [][]byte) error {
+	edits, ok := diff(a, b)
+	if !ok {
+		return ErrTooManyChanges
+	}
+
+	hunks := hunks(edits)
+	if len(hunks) == 0 {
+		return nil
+	}
+
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", aName, bName); err != nil {
+		return err
+	}
+
+	for _, h := range hunks {
+		if err := writeHunk(w, edits[h[0]:h[1]], a, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diff finds the shortest edit script turning a into b using the linear
+// space variant of the Myers' algorithm. false is returned if it would
+// take more than MaxEdits changed lines.
+func diff(a, b [][]byte) ([]edit, bool) {
+	var (
+		n, m = len(a), len(b)
+		size = n + m + 3
+	)
+
+	s := &script{
+		a:   a,
+		b:   b,
+		vf:  make([]int, size),
+		vb:  make([]int, size),
+		off: m + 1,
+	}
+
+	if !s.compare(0, n, 0, m) {
+		return nil, false
+	}
+
+	return s.edits, true
+}
+
+// script builds the edit script of a and b, see diff
+type script struct {
+	a, b [][]byte
+	// The furthest reaching paths on each diagonal x-y, offset by off,
+	// from the start and from the end of the compared ranges
+	vf, vb []int
+	off    int
+	edits  []edit
+}
+
+// compare appends the edits turning a[aLo:aHi] into b[bLo:bHi]
+func (s *script) compare(aLo, aHi, bLo, bHi int) bool {
+	for aLo < aHi && bLo < bHi && bytes.Equal(s.a[aLo], s.b[bLo]) {
+		s.edits = append(s.edits, edit{editEqual, aLo, bLo})
+		aLo++
+		bLo++
+	}
+
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && bytes.Equal(s.a[aHi-suffix-1], s.b[bHi-suffix-1]) {
+		suffix++
+	}
+
+	aHi -= suffix
+	bHi -= suffix
+
+	switch {
+	case aLo == aHi:
+		for ; bLo < bHi; bLo++ {
+			s.edits = append(s.edits, edit{editInsert, aLo, bLo})
+		}
+	case bLo == bHi:
+		for ; aLo < aHi; aLo++ {
+			s.edits = append(s.edits, edit{editDelete, aLo, bLo})
+		}
+	default:
+		x, y, ok := s.split(aLo, aHi, bLo, bHi)
+		if !ok || !s.compare(aLo, x, bLo, y) || !s.compare(x, aHi, y, bHi) {
+			return false
+		}
+	}
+
+	for i := 0; i < suffix; i++ {
+		s.edits = append(s.edits, edit{editEqual, aHi + i, bHi + i})
+	}
+
+	return true
+}
+
+// split finds a point on a shortest path through the edit graph
+// of a[aLo:aHi] and b[bLo:bHi], whose first and last lines differ,
+// by searching from both ends until the paths overlap in the middle.
+// Diagonals are kept within the graph, those beyond it hold sentinels.
+func (s *script) split(aLo, aHi, bLo, bHi int) (int, int, bool) {
+	var (
+		vf, vb, off = s.vf, s.vb, s.off
+		kMin, kMax  = aLo - bHi, aHi - bLo
+		fMid, bMid  = aLo - bLo, aHi - bHi
+		fMin, fMax  = fMid, fMid
+		bMin, bMax  = bMid, bMid
+		odd         = (fMid-bMid)&1 != 0
+	)
+
+	vf[off+fMid] = aLo
+	vb[off+bMid] = aHi
+
+	for d := 1; ; d++ {
+		if 2*d-1 > MaxEdits {
+			return 0, 0, false
+		}
+
+		if fMin > kMin {
+			fMin--
+			vf[off+fMin-1] = -1
+		} else {
+			fMin++
+		}
+
+		if fMax < kMax {
+			fMax++
+			vf[off+fMax+1] = -1
+		} else {
+			fMax--
+		}
+
+		for k := fMax; k >= fMin; k -= 2 {
+			var x int
+			if vf[off+k-1] >= vf[off+k+1] {
+				x = vf[off+k-1] + 1
+			} else {
+				x = vf[off+k+1]
+			}
+
+			y := x - k
+			for x < aHi && y < bHi && bytes.Equal(s.a[x], s.b[y]) {
+				x++
+				y++
+			}
+
+			vf[off+k] = x
+
+			if odd && bMin <= k && k <= bMax && vb[off+k] <= x {
+				return x, y, true
+			}
+		}
+
+		if bMin > kMin {
+			bMin--
+			vb[off+bMin-1] = math.MaxInt32
+		} else {
+			bMin++
+		}
+
+		if bMax < kMax {
+			bMax++
+			vb[off+bMax+1] = math.MaxInt32
+		} else {
+			bMax--
+		}
+
+		for k := bMax; k >= bMin; k -= 2 {
+			var x int
+			if vb[off+k-1] < vb[off+k+1] {
+				x = vb[off+k-1]
+			} else {
+				x = vb[off+k+1] - 1
+			}
+
+			y := x - k
+			for x > aLo && y > bLo && bytes.Equal(s.a[x-1], s.b[y-1]) {
+				x--
+				y--
+			}
+
+			vb[off+k] = x
+
+			if !odd && fMin <= k && k <= fMax && x <= vf[off+k] {
+				return x, y, true
+			}
+		}
+	}
+}
+
+// hunks groups the changes along with their context into ranges of edits.
+// Changes closer to each other than twice the context share a hunk.
+func hunks(edits []edit) [][2]int {
+	var (
+		hs   [][2]int
+		last = -1
+	)
+
+	for i := range edits {
+		if edits[i].kind == editEqual {
+			continue
+		}
+
+		start := i - Context
+		if start < 0 {
+			start = 0
+		}
+
+		end := i + Context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		if last >= 0 && start <= hs[last][1] {
+			hs[last][1] = end
+		} else {
+			hs = append(hs, [2]int{start, end})
+			last++
+		}
+	}
+
+	return hs
+}
+
+func writeHunk(w io.Writer, edits []edit, a, b [][]byte) error {
+	var (
+		aStart, bStart = -1, -1
+		aLen, bLen     int
+	)
+
+	for _, e := range edits {
+		if e.kind != editInsert {
+			if aStart < 0 {
+				aStart = e.a
+			}
+			aLen++
+		}
+
+		if e.kind != editDelete {
+			if bStart < 0 {
+				bStart = e.b
+			}
+			bLen++
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(aStart, aLen, edits[0].a), hunkRange(bStart, bLen, edits[0].b)); err != nil {
+		return err
+	}
+
+	for _, e := range edits {
+		line := a[e.a:]
+		if e.kind == editInsert {
+			line = b[e.b:]
+		}
+
+		if err := writeLine(w, byte(e.kind), line[0]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hunkRange formats the 1-based line range of a hunk. Empty ranges
+// refer to the line before, where the lines of the other file belong.
+func hunkRange(start, length, pos int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", pos)
+	}
+
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func writeLine(w io.Writer, prefix byte, line []byte) error {
+	if _, err := w.Write([]byte{prefix}); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(line); err != nil {
+		return err
+	}
+
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		_, err := io.WriteString(w, "\n\\ No newline at end of file\n")
+		return err
+	}
+
+	return nil
+}
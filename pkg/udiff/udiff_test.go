@@ -0,0 +1,268 @@
+package udiff
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lines splits s into lines the way Lines does
+func lines(s string) [][]byte {
+	return Lines([]byte(s))
+}
+
+func writeString(t *testing.T, a, b string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Write(&buf, "a/f", "b/f", lines(a), lines(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+// lcsLen finds the length of the longest common subsequence of a and b
+func lcsLen(a, b [][]byte) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case bytes.Equal(a[i], b[j]):
+				dp[i][j] = dp[i+1][j+1] + 1
+			case dp[i+1][j] > dp[i][j+1]:
+				dp[i][j] = dp[i+1][j]
+			default:
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+
+	return dp[0][0]
+}
+
+// checkEdits verifies that edits turn a into b in the fewest changes
+func checkEdits(t *testing.T, a, b [][]byte, edits []edit) {
+	t.Helper()
+
+	var (
+		x, y    int
+		changes int
+	)
+
+	for _, e := range edits {
+		if e.a != x || e.b != y {
+			t.Fatalf("%q -> %q: edit %c at %d,%d, expected %d,%d", a, b, e.kind, e.a, e.b, x, y)
+		}
+
+		switch e.kind {
+		case editEqual:
+			if !bytes.Equal(a[x], b[y]) {
+				t.Fatalf("%q -> %q: %q and %q aren't equal", a, b, a[x], b[y])
+			}
+			x++
+			y++
+		case editDelete:
+			x++
+			changes++
+		case editInsert:
+			y++
+			changes++
+		}
+	}
+
+	if x != len(a) || y != len(b) {
+		t.Fatalf("%q -> %q: edits end at %d,%d", a, b, x, y)
+	}
+
+	if min := len(a) + len(b) - 2*lcsLen(a, b); changes != min {
+		t.Errorf("%q -> %q: %d changes, expected %d", a, b, changes, min)
+	}
+}
+
+func randomLines(r *rand.Rand, alphabet string) [][]byte {
+	ls := make([][]byte, r.Intn(12))
+	for i := range ls {
+		ls[i] = []byte{alphabet[r.Intn(len(alphabet))], '\n'}
+	}
+
+	return ls
+}
+
+func TestDiffShortest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20000; i++ {
+		alphabet := "ab"
+		if i%2 != 0 {
+			alphabet = "abcde"
+		}
+
+		a, b := randomLines(r, alphabet), randomLines(r, alphabet)
+
+		edits, ok := diff(a, b)
+		if !ok {
+			t.Fatalf("%q -> %q: too many changes", a, b)
+		}
+
+		checkEdits(t, a, b, edits)
+	}
+}
+
+func TestDiffLarge(t *testing.T) {
+	var (
+		r    = rand.New(rand.NewSource(1))
+		a, b [][]byte
+	)
+
+	for i := 0; i < 2000; i++ {
+		line := []byte(strings.Repeat("x", r.Intn(3)) + "\n")
+
+		if r.Intn(10) != 0 {
+			a = append(a, line)
+		}
+
+		if r.Intn(10) != 0 {
+			b = append(b, line)
+		}
+	}
+
+	edits, ok := diff(a, b)
+	if !ok {
+		t.Fatal("too many changes")
+	}
+
+	checkEdits(t, a, b, edits)
+}
+
+func TestMaxEdits(t *testing.T) {
+	defer func(max int) { MaxEdits = max }(MaxEdits)
+	MaxEdits = 4
+
+	var buf bytes.Buffer
+
+	if err := Write(&buf, "a/f", "b/f", lines("1\n2\n3\n"), lines("4\n5\n6\n")); err != ErrTooManyChanges {
+		t.Errorf("6 changes: %v, expected %v", err, ErrTooManyChanges)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("written %q", buf.String())
+	}
+
+	if err := Write(&buf, "a/f", "b/f", lines("1\n2\n3\n"), lines("1\n5\n6\n")); err != nil {
+		t.Errorf("4 changes: %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name, a, b, diff string
+	}{
+		{
+			name: "same",
+			a:    "1\n2\n",
+			b:    "1\n2\n",
+			diff: "",
+		},
+		{
+			name: "both empty",
+			diff: "",
+		},
+		{
+			name: "added",
+			a:    "",
+			b:    "1\n2\n",
+			diff: "--- a/f\n+++ b/f\n@@ -0,0 +1,2 @@\n+1\n+2\n",
+		},
+		{
+			name: "deleted",
+			a:    "1\n",
+			b:    "",
+			diff: "--- a/f\n+++ b/f\n@@ -1 +0,0 @@\n-1\n",
+		},
+		{
+			name: "replaced",
+			a:    "1\n2\n3\n",
+			b:    "1\nx\n3\n",
+			diff: "--- a/f\n+++ b/f\n@@ -1,3 +1,3 @@\n 1\n-2\n+x\n 3\n",
+		},
+		{
+			name: "no trailing newline added",
+			a:    "1\n2",
+			b:    "1\n2\n",
+			diff: "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n 1\n-2\n\\ No newline at end of file\n+2\n",
+		},
+		{
+			name: "no trailing newline kept",
+			a:    "1\n2",
+			b:    "0\n1\n2",
+			diff: "--- a/f\n+++ b/f\n@@ -1,2 +1,3 @@\n+0\n 1\n 2\n\\ No newline at end of file\n",
+		},
+		{
+			// Only Context lines are shown around the change
+			name: "context",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "1\n2\n3\n4\nx\n6\n7\n8\n9\n",
+			diff: "--- a/f\n+++ b/f\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n",
+		},
+		{
+			// Inserted after the last line, the empty range refers to it
+			name: "appended",
+			a:    "1\n2\n3\n4\n5\n",
+			b:    "1\n2\n3\n4\n5\n6\n",
+			diff: "--- a/f\n+++ b/f\n@@ -3,3 +3,4 @@\n 3\n 4\n 5\n+6\n",
+		},
+		{
+			// At most twice the context apart, the changes share a hunk
+			name: "merged hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:    "x\n2\n3\n4\n5\n6\n7\ny\n",
+			diff: "--- a/f\n+++ b/f\n@@ -1,8 +1,8 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "x\n2\n3\n4\n5\n6\n7\n8\ny\n",
+			diff: "--- a/f\n+++ b/f\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -6,4 +6,4 @@\n 6\n 7\n 8\n-9\n+y\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := writeString(t, tt.a, tt.b); got != tt.diff {
+			t.Errorf("%s:\n%s\nexpected:\n%s", tt.name, got, tt.diff)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		data  string
+		lines []string
+	}{
+		{"", nil},
+		{"\n", []string{"\n"}},
+		{"1\n2", []string{"1\n", "2"}},
+		{"1\n\n2\n", []string{"1\n", "\n", "2\n"}},
+	}
+
+	for _, tt := range tests {
+		got := lines(tt.data)
+
+		if len(got) != len(tt.lines) {
+			t.Errorf("%q: %q, expected %q", tt.data, got, tt.lines)
+			continue
+		}
+
+		for i := range got {
+			if string(got[i]) != tt.lines[i] {
+				t.Errorf("%q: %q, expected %q", tt.data, got, tt.lines)
+				break
+			}
+		}
+	}
+}